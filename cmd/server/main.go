@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+	_ "time/tzdata" // Time zones of reset schedules on hosts without zoneinfo
 
 	"go-forward-proxy/internal/api"
 	"go-forward-proxy/internal/config"
@@ -34,12 +37,21 @@ func main() {
 	log.Println("Database initialized successfully")
 
 	// 3. Initialize proxy services
-	tmService := proxyservices.NewTMProxyService()
-	kiotService := proxyservices.NewKiotProxyService()
+	services := proxyservices.NewRegistry()
+	if err := services.Register(proxyservices.NewTMProxyService()); err != nil {
+		log.Fatalf("Failed to register provider: %v", err)
+	}
+	if err := services.Register(proxyservices.NewKiotProxyService()); err != nil {
+		log.Fatalf("Failed to register provider: %v", err)
+	}
 
-	services := map[string]proxyservices.ProxyService{
-		"tmproxy":   tmService,
-		"kiotproxy": kiotService,
+	// Providers with common API shape are defined in config file (optional)
+	if cfg.ProvidersFile != "" {
+		names, err := proxyservices.LoadGenericServices(services, cfg.ProvidersFile)
+		if err != nil {
+			log.Fatalf("Failed to load providers from %s: %v", cfg.ProvidersFile, err)
+		}
+		log.Printf("Loaded %d provider(s) from %s: %v", len(names), cfg.ProvidersFile, names)
 	}
 
 	log.Println("Proxy services initialized")
@@ -47,25 +59,87 @@ func main() {
 	// 4. Initialize proxy manager
 	mgr := proxymanager.NewManager(db, cfg, services)
 
+	// Traffic of instances is counted from the moment they start
+	usage := proxymanager.NewUsageRecorder(db, cfg.UsageFlushInterval, cfg.UsageRetentionDays)
+	mgr.SetUsageRecorder(usage)
+
+	// Egress IP of proxies is verified after every rotation (optional)
+	if cfg.IPCheckTimeout > 0 {
+		mgr.SetEgressVerifier(proxymanager.NewEgressVerifier(db, cfg.IPCheckURL, cfg.IPCheckTimeout, cfg.IPHistoryRetention))
+	}
+
 	// 5. Start all existing proxies
 	if err := mgr.StartAll(); err != nil {
-		log.Fatalf("Failed to start existing proxies: %v", err)
+		var startErr *proxymanager.StartAllError
+		if !errors.As(err, &startErr) {
+			log.Fatalf("Failed to start existing proxies: %v", err)
+		}
+		for id, err := range startErr.Failed {
+			log.Printf("WARNING: proxy %d is not running: %v", id, err)
+		}
 	}
 
 	log.Println("All existing proxies started")
 
+	// Start gateway listener (optional)
+	if err := mgr.StartGateway(); err != nil {
+		log.Fatalf("Failed to start gateway: %v", err)
+	}
+
+	// Webhooks are saved from manager events, so dispatcher subscribes
+	// before anything is rotated
+	webhooks := proxymanager.NewWebhookDispatcher(mgr, db, cfg)
+
 	// 6. Start auto-reset service
-	autoReset := proxymanager.NewAutoResetService(mgr, db, services, cfg.AutoResetInterval)
+	autoReset := proxymanager.NewAutoResetService(mgr, db, cfg)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go autoReset.Start(ctx)
 
+	// Client traffic failures trigger early reset as well
+	mgr.SetResetRequester(autoReset.RequestReset)
+
 	log.Println("Auto-reset service started")
 
-	// 7. Setup API router
-	router := api.SetupRouter(mgr, cfg)
+	// 7. Start upstream health checker
+	healthChecker := proxymanager.NewHealthChecker(
+		mgr,
+		cfg.HealthCheckTarget,
+		cfg.HealthCheckInterval,
+		cfg.HealthCheckTimeout,
+		cfg.HealthCheckFailures,
+		autoReset.RequestReset,
+	)
+
+	go healthChecker.Start(ctx)
 
-	// 8. Start API server in goroutine
+	// Warn before provider keys expire
+	expiryMonitor := proxymanager.NewExpiryMonitor(mgr, cfg.ExpiryWarnHours)
+
+	go expiryMonitor.Start(ctx)
+
+	// Flush traffic usage into database periodically
+	go usage.Start(ctx)
+
+	// Send queued webhook deliveries. Dispatcher is stopped last, so events
+	// of API requests and instances stopping during shutdown are sent.
+	webhooksCtx, webhooksCancel := context.WithCancel(context.Background())
+	webhooksDone := make(chan struct{})
+	go func() {
+		webhooks.Start(webhooksCtx)
+		close(webhooksDone)
+	}()
+
+	// 8. Setup API router
+	router := api.SetupRouter(mgr, webhooks, cfg)
+
+	// Request contexts are cancelled on shutdown, so provider calls made by
+	// API requests don't hold it up
+	router.Server.BaseContext = func(net.Listener) context.Context {
+		return ctx
+	}
+
+	// 9. Start API server in goroutine
 	go func() {
 		addr := fmt.Sprintf(":%d", cfg.APIPort)
 		log.Printf("Starting API server on %s", addr)
@@ -74,22 +148,32 @@ func main() {
 		}
 	}()
 
-	// 9. Wait for shutdown signal
+	// 10. Wait for shutdown signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
 	<-sigChan
 	log.Println("\nShutdown signal received, gracefully shutting down...")
 
-	// 10. Graceful shutdown
-	// Stop auto-reset service
+	// 11. Graceful shutdown
+	// Stop auto-reset service and health checker, cancelling their and API
+	// requests' provider calls
 	cancel()
 
-	// Stop all proxy instances
-	if err := mgr.StopAll(); err != nil {
+	// Stop all proxy instances in parallel, letting active tunnels finish
+	// until shutdown timeout
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer drainCancel()
+
+	if err := mgr.StopAll(drainCtx); err != nil {
 		log.Printf("Error stopping proxy instances: %v", err)
 	}
 
+	// Save traffic counted since last flush
+	if err := usage.Flush(); err != nil {
+		log.Printf("Error flushing traffic usage: %v", err)
+	}
+
 	// Shutdown API server
 	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
@@ -98,5 +182,9 @@ func main() {
 		log.Printf("Error shutting down API server: %v", err)
 	}
 
+	// Deliveries not sent by now stay in outbox until next start
+	webhooksCancel()
+	<-webhooksDone
+
 	log.Println("Shutdown complete")
 }
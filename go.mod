@@ -9,6 +9,7 @@ replace go-forward-proxy/pkg/dumbproxy => ./pkg/dumbproxy
 require (
 	github.com/joho/godotenv v1.5.1
 	github.com/labstack/echo/v4 v4.14.0
+	github.com/things-go/go-socks5 v0.1.0
 	go-forward-proxy/pkg/dumbproxy v0.0.0-00010101000000-000000000000
 	modernc.org/sqlite v1.40.1
 )
@@ -37,7 +38,6 @@ require (
 	github.com/refraction-networking/utls v1.8.1 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/tg123/go-htpasswd v1.2.4 // indirect
-	github.com/things-go/go-socks5 v0.1.0 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasttemplate v1.2.2 // indirect
 	golang.org/x/crypto v0.46.0 // indirect
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go-forward-proxy/internal/proxymanager"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ConnectionHandler struct {
+	manager *proxymanager.Manager
+}
+
+func NewConnectionHandler(mgr *proxymanager.Manager) *ConnectionHandler {
+	return &ConnectionHandler{
+		manager: mgr,
+	}
+}
+
+// GET /api/proxies/:id/connections
+func (h *ConnectionHandler) ListConnections(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	conns, err := h.manager.ListConnections(uint(id))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrInstanceNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, conns)
+}
+
+// DELETE /api/proxies/:id/connections/:conn_id
+func (h *ConnectionHandler) KillConnection(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	connIDStr := c.Param("conn_id")
+	connID, err := strconv.ParseUint(connIDStr, 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid connection ID",
+		})
+	}
+
+	if err := h.manager.KillConnection(uint(id), connID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrInstanceNotFound) || errors.Is(err, proxymanager.ErrConnectionNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
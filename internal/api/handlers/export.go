@@ -2,7 +2,10 @@ package handlers
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"go-forward-proxy/internal/config"
@@ -23,8 +26,10 @@ func NewExportHandler(mgr *proxymanager.Manager, cfg *config.Config) *ExportHand
 	}
 }
 
-// GET /api/export
+// GET /api/export?credentials=true
 func (h *ExportHandler) ExportText(c echo.Context) error {
+	withCredentials := c.QueryParam("credentials") == "true"
+
 	proxies, err := h.manager.GetAllProxies()
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{
@@ -32,11 +37,31 @@ func (h *ExportHandler) ExportText(c echo.Context) error {
 		})
 	}
 
+	// HTTP endpoints keep plain host:port format, credentials are appended
+	// as host:port:username:password on request. SOCKS5 ones are URLs with
+	// credentials in userinfo. Paused and disabled proxies refuse traffic,
+	// so only active ones are exported.
 	var lines []string
 	for _, proxy := range proxies {
-		port := proxy.ID + 10000
-		line := fmt.Sprintf("%s:%d", h.config.ServerIP, port)
-		lines = append(lines, line)
+		if proxy.Status != proxymanager.StatusActive {
+			continue
+		}
+
+		hostPort := net.JoinHostPort(h.config.ServerIP, strconv.Itoa(proxy.Port))
+		if proxy.Mode != proxymanager.ModeSOCKS5 {
+			endpoint := hostPort
+			if withCredentials {
+				endpoint = fmt.Sprintf("%s:%s:%s", hostPort, proxy.Username, proxy.Password)
+			}
+			lines = append(lines, endpoint)
+		}
+		if proxy.Mode == proxymanager.ModeSOCKS5 || proxy.Mode == proxymanager.ModeBoth {
+			endpoint := &url.URL{Scheme: "socks5", Host: hostPort}
+			if withCredentials {
+				endpoint.User = url.UserPassword(proxy.Username, proxy.Password)
+			}
+			lines = append(lines, endpoint.String())
+		}
 	}
 
 	text := strings.Join(lines, "\n")
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go-forward-proxy/internal/proxymanager"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Number of IP history entries returned by default and at most
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+type HistoryHandler struct {
+	manager *proxymanager.Manager
+}
+
+func NewHistoryHandler(mgr *proxymanager.Manager) *HistoryHandler {
+	return &HistoryHandler{
+		manager: mgr,
+	}
+}
+
+// GET /api/proxies/:id/history?limit=
+func (h *HistoryHandler) GetHistory(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	limit := defaultHistoryLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxHistoryLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "limit must be between 1 and " + strconv.Itoa(maxHistoryLimit),
+			})
+		}
+	}
+
+	history, err := h.manager.ProxyIPHistory(uint(id), limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrProxyNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
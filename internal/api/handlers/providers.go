@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"go-forward-proxy/internal/proxymanager"
+	"go-forward-proxy/internal/proxyservices"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ProviderHandler struct {
+	manager *proxymanager.Manager
+}
+
+func NewProviderHandler(mgr *proxymanager.Manager) *ProviderHandler {
+	return &ProviderHandler{
+		manager: mgr,
+	}
+}
+
+// GET /api/providers
+func (h *ProviderHandler) ListProviders(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.manager.ServiceTypes())
+}
+
+// GET /api/providers/:name/options
+func (h *ProviderHandler) ListOptions(c echo.Context) error {
+	options, err := h.manager.ProviderOptions(c.Request().Context(), c.Param("name"))
+	if err != nil {
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, proxymanager.ErrUnknownService):
+			status = http.StatusNotFound
+		case errors.Is(err, proxyservices.ErrOptionsNotSupported):
+			status = http.StatusNotImplemented
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, options)
+}
@@ -1,10 +1,18 @@
 package handlers
 
 import (
+	"context"
+	"errors"
+	"math"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
+	"go-forward-proxy/internal/database/models"
 	"go-forward-proxy/internal/proxymanager"
+	"go-forward-proxy/internal/proxyservices"
 
 	"github.com/labstack/echo/v4"
 )
@@ -20,9 +28,27 @@ func NewProxyHandler(mgr *proxymanager.Manager) *ProxyHandler {
 }
 
 type UpsertProxyRequest struct {
-	APIKey       string `json:"api_key" validate:"required"`
-	ServiceType  string `json:"service_type" validate:"required"`
-	MinTimeReset int    `json:"min_time_reset" validate:"required,min=1"`
+	APIKey      string `json:"api_key" validate:"required"`
+	ServiceType string `json:"service_type" validate:"required"`
+	// Required on insert unless reset_schedule is set, kept on update
+	// when left out
+	MinTimeReset *int   `json:"min_time_reset" validate:"required_without=ResetSchedule,omitempty,min=1"`
+	Port         int    `json:"port"` // Optional, allocated automatically when 0
+	Mode         string `json:"mode"` // Optional: "http" (default), "socks5" or "both"
+	// Optional provider endpoint instance dials: "http" (default) or
+	// "socks5"
+	UpstreamProtocol string `json:"upstream_protocol"`
+	// Optional cron schedule, e.g. "CRON_TZ=Asia/Ho_Chi_Minh 0 0,12 * * *".
+	// Replaces min_time_reset interval when set, "" switches back to it.
+	// Settings below are kept on update when left out.
+	ResetSchedule *string `json:"reset_schedule"`
+	// Optional, seconds within which exit IP used before is rejected on
+	// rotation. With ip_freshness_global IPs of all proxies count.
+	IPFreshnessWindow *int  `json:"ip_freshness_window"`
+	IPFreshnessGlobal *bool `json:"ip_freshness_global"`
+	// Optional provider parameters of new proxy requests, e.g.
+	// {"location": 5, "isp": 2}, {} resets them to provider defaults
+	ProviderOptions map[string]any `json:"provider_options"`
 }
 
 // POST /api/proxies
@@ -35,16 +61,75 @@ func (h *ProxyHandler) CreateProxy(c echo.Context) error {
 	}
 
 	// Validate service type
-	if req.ServiceType != "tmproxy" && req.ServiceType != "kiotproxy" {
+	if serviceTypes := h.manager.ServiceTypes(); !slices.Contains(serviceTypes, req.ServiceType) {
 		return c.JSON(http.StatusBadRequest, map[string]string{
-			"error": "service_type must be 'tmproxy' or 'kiotproxy'",
+			"error": "service_type must be one of: " + strings.Join(serviceTypes, ", "),
 		})
 	}
 
-	// Upsert proxy (insert or update based on api_key)
-	proxy, err := h.manager.UpsertProxy(req.APIKey, req.ServiceType, req.MinTimeReset)
+	// Validate listener mode
+	if req.Mode != "" && !proxymanager.ValidMode(req.Mode) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "mode must be 'http', 'socks5' or 'both'",
+		})
+	}
+
+	// Validate upstream protocol
+	if req.UpstreamProtocol != "" && !proxymanager.ValidUpstreamProtocol(req.UpstreamProtocol) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "upstream_protocol must be 'http' or 'socks5'",
+		})
+	}
+
+	// Validate reset schedule. Whether min_time_reset is needed depends on
+	// schedule proxy keeps, so manager checks that.
+	if req.ResetSchedule != nil && *req.ResetSchedule != "" {
+		if _, err := proxymanager.ParseResetSchedule(*req.ResetSchedule); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": err.Error(),
+			})
+		}
+	}
+	if req.MinTimeReset != nil && *req.MinTimeReset < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": proxymanager.ErrInvalidMinTimeReset.Error(),
+		})
+	}
+
+	// Validate IP freshness window
+	if req.IPFreshnessWindow != nil && *req.IPFreshnessWindow < 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "ip_freshness_window must not be negative",
+		})
+	}
+
+	// Upsert proxy (insert or update based on api_key). Provider call is
+	// cancelled if client disconnects.
+	proxy, err := h.manager.UpsertProxy(c.Request().Context(), proxymanager.UpsertParams{
+		APIKey:        req.APIKey,
+		ServiceType:   req.ServiceType,
+		MinTimeReset:  req.MinTimeReset,
+		ResetSchedule: req.ResetSchedule,
+		Port:          req.Port,
+		Mode:          req.Mode,
+
+		UpstreamProtocol:  req.UpstreamProtocol,
+		IPFreshnessWindow: req.IPFreshnessWindow,
+		IPFreshnessGlobal: req.IPFreshnessGlobal,
+		ProviderOptions:   req.ProviderOptions,
+	})
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, proxymanager.ErrPortOutOfRange), errors.Is(err, proxymanager.ErrInvalidMode), errors.Is(err, proxymanager.ErrUnknownService),
+			errors.Is(err, proxymanager.ErrInvalidSchedule), errors.Is(err, proxymanager.ErrInvalidMinTimeReset), errors.Is(err, proxymanager.ErrInvalidFreshnessWindow), errors.Is(err, proxymanager.ErrFreshnessUnavailable),
+			errors.Is(err, proxyservices.ErrInvalidOptions), errors.Is(err, proxymanager.ErrInvalidUpstreamProtocol),
+			errors.Is(err, proxymanager.ErrNoSOCKS5Endpoint):
+			status = http.StatusBadRequest
+		case errors.Is(err, proxymanager.ErrPortTaken), errors.Is(err, proxymanager.ErrNoFreePort):
+			status = http.StatusConflict
+		}
+		return c.JSON(status, map[string]string{
 			"error": err.Error(),
 		})
 	}
@@ -52,7 +137,7 @@ func (h *ProxyHandler) CreateProxy(c echo.Context) error {
 	return c.JSON(http.StatusOK, proxy)
 }
 
-// DELETE /api/proxies/:id
+// DELETE /api/proxies/:id?purge=true
 func (h *ProxyHandler) DeleteProxy(c echo.Context) error {
 	idStr := c.Param("id")
 	id, err := strconv.ParseUint(idStr, 10, 32)
@@ -62,8 +147,12 @@ func (h *ProxyHandler) DeleteProxy(c echo.Context) error {
 		})
 	}
 
-	if err := h.manager.DeleteProxy(uint(id)); err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{
+	if err := h.manager.DeleteProxy(uint(id), c.QueryParam("purge") == "true"); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrProxyNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
 			"error": err.Error(),
 		})
 	}
@@ -71,6 +160,12 @@ func (h *ProxyHandler) DeleteProxy(c echo.Context) error {
 	return c.NoContent(http.StatusNoContent)
 }
 
+// ProxyWithUsage is proxy together with its stored traffic totals
+type ProxyWithUsage struct {
+	models.Proxy
+	proxymanager.UsageBytes
+}
+
 // GET /api/proxies
 func (h *ProxyHandler) ListProxies(c echo.Context) error {
 	proxies, err := h.manager.GetAllProxies()
@@ -80,5 +175,134 @@ func (h *ProxyHandler) ListProxies(c echo.Context) error {
 		})
 	}
 
-	return c.JSON(http.StatusOK, proxies)
+	totals, err := h.manager.UsageTotals()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	result := make([]ProxyWithUsage, 0, len(proxies))
+	for _, proxy := range proxies {
+		result = append(result, ProxyWithUsage{
+			Proxy:      proxy,
+			UsageBytes: totals[proxy.ID],
+		})
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+type RotateCredentialsRequest struct {
+	Username string `json:"username"` // Optional, generated when empty
+	Password string `json:"password"` // Optional, generated when empty
+}
+
+// POST /api/proxies/:id/credentials/rotate
+func (h *ProxyHandler) RotateCredentials(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	var req RotateCredentialsRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Colon separates fields of exported host:port:username:password lines
+	if strings.Contains(req.Username, ":") || strings.Contains(req.Password, ":") {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "username and password must not contain ':'",
+		})
+	}
+
+	proxy, err := h.manager.RotateCredentials(uint(id), req.Username, req.Password)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrProxyNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, proxy)
+}
+
+// POST /api/proxies/:id/rotate
+func (h *ProxyHandler) RotateProxy(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	proxy, err := h.manager.RotateProxy(c.Request().Context(), uint(id))
+	if err != nil {
+		var cooldown *proxymanager.CooldownError
+		var expired *proxymanager.ExpiredError
+		status := http.StatusInternalServerError
+		switch {
+		case errors.As(err, &cooldown):
+			retryAfter := math.Ceil(cooldown.RetryAfter(time.Now()).Seconds())
+			c.Response().Header().Set("Retry-After", strconv.Itoa(max(int(retryAfter), 1)))
+			status = http.StatusTooManyRequests
+		case errors.Is(err, proxymanager.ErrProxyNotFound):
+			status = http.StatusNotFound
+		case errors.As(err, &expired), errors.Is(err, proxymanager.ErrProxyNotActive):
+			status = http.StatusConflict
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, proxy)
+}
+
+// POST /api/proxies/:id/pause
+func (h *ProxyHandler) PauseProxy(c echo.Context) error {
+	return h.setStatus(c, h.manager.PauseProxy)
+}
+
+// POST /api/proxies/:id/resume
+func (h *ProxyHandler) ResumeProxy(c echo.Context) error {
+	return h.setStatus(c, h.manager.ResumeProxy)
+}
+
+// POST /api/proxies/:id/disable
+func (h *ProxyHandler) DisableProxy(c echo.Context) error {
+	return h.setStatus(c, h.manager.DisableProxy)
+}
+
+func (h *ProxyHandler) setStatus(c echo.Context, apply func(ctx context.Context, id uint) (*models.Proxy, error)) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	proxy, err := apply(c.Request().Context(), uint(id))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrProxyNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, proxy)
 }
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-forward-proxy/internal/proxymanager"
+
+	"github.com/labstack/echo/v4"
+)
+
+// defaultUsageRange is time range of usage report when from is not given
+const defaultUsageRange = 24 * time.Hour
+
+type UsageHandler struct {
+	manager *proxymanager.Manager
+}
+
+func NewUsageHandler(mgr *proxymanager.Manager) *UsageHandler {
+	return &UsageHandler{
+		manager: mgr,
+	}
+}
+
+// GET /api/proxies/:id/usage?from=&to=&granularity=
+func (h *UsageHandler) GetUsage(c echo.Context) error {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid proxy ID",
+		})
+	}
+
+	to := time.Now().UTC()
+	if toStr := c.QueryParam("to"); toStr != "" {
+		if to, err = time.Parse(time.RFC3339, toStr); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "to must be RFC3339 time",
+			})
+		}
+	}
+
+	from := to.Add(-defaultUsageRange)
+	if fromStr := c.QueryParam("from"); fromStr != "" {
+		if from, err = time.Parse(time.RFC3339, fromStr); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "from must be RFC3339 time",
+			})
+		}
+	}
+
+	if !from.Before(to) {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "from must be before to",
+		})
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = proxymanager.GranularityHour
+	}
+	if granularity != proxymanager.GranularityHour && granularity != proxymanager.GranularityDay {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "granularity must be 'hour' or 'day'",
+		})
+	}
+
+	report, err := h.manager.ProxyUsage(uint(id), from, to, granularity)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrProxyNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
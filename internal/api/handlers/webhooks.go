@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"go-forward-proxy/internal/proxymanager"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Number of webhook deliveries returned by default and at most
+const (
+	defaultDeliveriesLimit = 100
+	maxDeliveriesLimit     = 1000
+)
+
+type WebhookHandler struct {
+	webhooks *proxymanager.WebhookDispatcher
+}
+
+func NewWebhookHandler(wd *proxymanager.WebhookDispatcher) *WebhookHandler {
+	return &WebhookHandler{
+		webhooks: wd,
+	}
+}
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url" validate:"required"`
+	Secret string   `json:"secret"` // Optional, generated when empty
+	Events []string `json:"events"` // Optional, all events when empty
+}
+
+// POST /api/webhooks
+func (h *WebhookHandler) CreateWebhook(c echo.Context) error {
+	var req CreateWebhookRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid request body",
+		})
+	}
+
+	webhook, err := h.webhooks.CreateWebhook(req.URL, req.Secret, req.Events)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrInvalidWebhook) {
+			status = http.StatusBadRequest
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, webhook)
+}
+
+// GET /api/webhooks
+func (h *WebhookHandler) ListWebhooks(c echo.Context) error {
+	webhooks, err := h.webhooks.ListWebhooks()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	// Secret is shown only once, when webhook is created
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// DELETE /api/webhooks/:id
+func (h *WebhookHandler) DeleteWebhook(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	if err := h.webhooks.DeleteWebhook(uint(id)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrWebhookNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GET /api/webhooks/:id/deliveries?limit=
+func (h *WebhookHandler) ListDeliveries(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{
+			"error": "Invalid webhook ID",
+		})
+	}
+
+	limit := defaultDeliveriesLimit
+	if limitStr := c.QueryParam("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxDeliveriesLimit {
+			return c.JSON(http.StatusBadRequest, map[string]string{
+				"error": "limit must be between 1 and " + strconv.Itoa(maxDeliveriesLimit),
+			})
+		}
+	}
+
+	deliveries, err := h.webhooks.Deliveries(uint(id), limit)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, proxymanager.ErrWebhookNotFound) {
+			status = http.StatusNotFound
+		}
+		return c.JSON(status, map[string]string{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(http.StatusOK, deliveries)
+}
@@ -9,7 +9,7 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 )
 
-func SetupRouter(mgr *proxymanager.Manager, cfg *config.Config) *echo.Echo {
+func SetupRouter(mgr *proxymanager.Manager, webhooks *proxymanager.WebhookDispatcher, cfg *config.Config) *echo.Echo {
 	e := echo.New()
 
 	// Middleware
@@ -23,12 +23,32 @@ func SetupRouter(mgr *proxymanager.Manager, cfg *config.Config) *echo.Echo {
 	// Create handlers
 	proxyHandler := handlers.NewProxyHandler(mgr)
 	exportHandler := handlers.NewExportHandler(mgr, cfg)
+	connectionHandler := handlers.NewConnectionHandler(mgr)
+	usageHandler := handlers.NewUsageHandler(mgr)
+	historyHandler := handlers.NewHistoryHandler(mgr)
+	webhookHandler := handlers.NewWebhookHandler(webhooks)
+	providerHandler := handlers.NewProviderHandler(mgr)
 
 	// Register routes
 	api.POST("/proxies", proxyHandler.CreateProxy)
 	api.DELETE("/proxies/:id", proxyHandler.DeleteProxy)
 	api.GET("/proxies", proxyHandler.ListProxies)
+	api.POST("/proxies/:id/rotate", proxyHandler.RotateProxy)
+	api.POST("/proxies/:id/pause", proxyHandler.PauseProxy)
+	api.POST("/proxies/:id/resume", proxyHandler.ResumeProxy)
+	api.POST("/proxies/:id/disable", proxyHandler.DisableProxy)
+	api.POST("/proxies/:id/credentials/rotate", proxyHandler.RotateCredentials)
+	api.GET("/proxies/:id/connections", connectionHandler.ListConnections)
+	api.DELETE("/proxies/:id/connections/:conn_id", connectionHandler.KillConnection)
+	api.GET("/proxies/:id/usage", usageHandler.GetUsage)
+	api.GET("/proxies/:id/history", historyHandler.GetHistory)
 	api.GET("/export", exportHandler.ExportText)
+	api.POST("/webhooks", webhookHandler.CreateWebhook)
+	api.GET("/webhooks", webhookHandler.ListWebhooks)
+	api.DELETE("/webhooks/:id", webhookHandler.DeleteWebhook)
+	api.GET("/webhooks/:id/deliveries", webhookHandler.ListDeliveries)
+	api.GET("/providers", providerHandler.ListProviders)
+	api.GET("/providers/:name/options", providerHandler.ListOptions)
 
 	return e
 }
@@ -2,19 +2,53 @@ package config
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	ServerIP           string
-	APIPort            int
-	Username           string
-	Password           string
-	DatabasePath       string
-	AutoResetInterval  int
+	ServerIP              string
+	APIPort               int
+	Username              string
+	Password              string
+	DatabasePath          string
+	AutoResetRetryDelay   int
+	AutoResetWorkers      int
+	AutoResetJitter       int
+	AutoResetBackoffMax   int
+	AutoResetMaxFailures  int
+	UpstreamDrainTimeout  int
+	HealthCheckInterval   int
+	HealthCheckTarget     string
+	HealthCheckTimeout    int
+	HealthCheckFailures   int
+	UpstreamFailureBudget int
+	UpstreamFailureWindow int
+	PortRangeStart        int
+	PortRangeEnd          int
+	GatewayPort           int
+	GatewayUsername       string
+	GatewayPassword       string
+	GatewayStrategy       string
+	GatewaySessionTTL     int
+	UsageFlushInterval    int
+	UsageRetentionDays    int
+	ShutdownTimeout       int
+	ExpiryWarnHours       []int
+	IPCheckURL            string
+	IPCheckTimeout        int
+	IPHistoryRetention    int
+	IPFreshnessAttempts   int
+	IPFreshnessMaxWait    int
+	WebhookTimeout        int
+	WebhookMaxAttempts    int
+	WebhookBackoffMax     int
+	WebhookRetentionDays  int
+	ProvidersFile         string
 }
 
 func LoadConfig() (*Config, error) {
@@ -22,12 +56,44 @@ func LoadConfig() (*Config, error) {
 	_ = godotenv.Load()
 
 	cfg := &Config{
-		ServerIP:          getEnv("SERVER_IP", "localhost"),
-		APIPort:           getEnvAsInt("API_PORT", 8080),
-		Username:          getEnv("PROXY_USERNAME", "admin"),
-		Password:          getEnv("PROXY_PASSWORD", ""),
-		DatabasePath:      getEnv("DATABASE_PATH", "./data/proxies.db"),
-		AutoResetInterval: getEnvAsInt("AUTO_RESET_INTERVAL", 10),
+		ServerIP:              getEnv("SERVER_IP", "localhost"),
+		APIPort:               getEnvAsInt("API_PORT", 8080),
+		Username:              getEnv("PROXY_USERNAME", "admin"),
+		Password:              getEnv("PROXY_PASSWORD", ""),
+		DatabasePath:          getEnv("DATABASE_PATH", "./data/proxies.db"),
+		AutoResetRetryDelay:   getRenamedEnvAsInt("AUTO_RESET_RETRY_DELAY", "AUTO_RESET_INTERVAL", 10),
+		AutoResetWorkers:      getEnvAsInt("AUTO_RESET_WORKERS", 4),
+		AutoResetJitter:       getEnvAsInt("AUTO_RESET_JITTER", 30),
+		AutoResetBackoffMax:   getEnvAsInt("AUTO_RESET_BACKOFF_MAX", 3600),
+		AutoResetMaxFailures:  getEnvAsInt("AUTO_RESET_MAX_FAILURES", 10),
+		UpstreamDrainTimeout:  getEnvAsInt("UPSTREAM_DRAIN_TIMEOUT", 300),
+		HealthCheckInterval:   getEnvAsInt("HEALTH_CHECK_INTERVAL", 30),
+		HealthCheckTarget:     getEnv("HEALTH_CHECK_TARGET", "www.google.com:443"),
+		HealthCheckTimeout:    getEnvAsInt("HEALTH_CHECK_TIMEOUT", 10),
+		HealthCheckFailures:   getEnvAsInt("HEALTH_CHECK_FAILURES", 3),
+		UpstreamFailureBudget: getEnvAsInt("UPSTREAM_FAILURE_BUDGET", 5),
+		UpstreamFailureWindow: getEnvAsInt("UPSTREAM_FAILURE_WINDOW", 60),
+		PortRangeStart:        getEnvAsInt("PORT_RANGE_START", 10001),
+		PortRangeEnd:          getEnvAsInt("PORT_RANGE_END", 65535),
+		GatewayPort:           getEnvAsInt("GATEWAY_PORT", 0),
+		GatewayUsername:       getEnv("GATEWAY_USERNAME", "gateway"),
+		GatewayPassword:       getEnv("GATEWAY_PASSWORD", ""),
+		GatewayStrategy:       getEnv("GATEWAY_STRATEGY", "round_robin"),
+		GatewaySessionTTL:     getEnvAsInt("GATEWAY_SESSION_TTL", 600),
+		UsageFlushInterval:    getEnvAsInt("USAGE_FLUSH_INTERVAL", 60),
+		UsageRetentionDays:    getEnvAsInt("USAGE_RETENTION_DAYS", 90),
+		ShutdownTimeout:       getEnvAsInt("SHUTDOWN_TIMEOUT", 30),
+		ExpiryWarnHours:       getEnvAsIntList("EXPIRY_WARN_HOURS", []int{72, 24, 1}),
+		IPCheckURL:            getEnv("IP_CHECK_URL", "https://api.ipify.org"),
+		IPCheckTimeout:        getEnvAsInt("IP_CHECK_TIMEOUT", 10),
+		IPHistoryRetention:    getEnvAsInt("IP_HISTORY_RETENTION_DAYS", 30),
+		IPFreshnessAttempts:   getEnvAsInt("IP_FRESHNESS_ATTEMPTS", 3),
+		IPFreshnessMaxWait:    getEnvAsInt("IP_FRESHNESS_MAX_WAIT", 60),
+		WebhookTimeout:        getEnvAsInt("WEBHOOK_TIMEOUT", 10),
+		WebhookMaxAttempts:    getEnvAsInt("WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookBackoffMax:     getEnvAsInt("WEBHOOK_BACKOFF_MAX", 3600),
+		WebhookRetentionDays:  getEnvAsInt("WEBHOOK_RETENTION_DAYS", 7),
+		ProvidersFile:         os.Getenv("PROVIDERS_FILE"),
 	}
 
 	// Validate required fields
@@ -35,6 +101,15 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("PROXY_PASSWORD environment variable is required")
 	}
 
+	// Gateway reaches every proxy, so it does not share their login
+	if cfg.GatewayPort != 0 && cfg.GatewayPassword == "" {
+		return nil, fmt.Errorf("GATEWAY_PASSWORD environment variable is required when GATEWAY_PORT is set")
+	}
+
+	if cfg.PortRangeStart < 1 || cfg.PortRangeEnd > 65535 || cfg.PortRangeStart > cfg.PortRangeEnd {
+		return nil, fmt.Errorf("invalid port range %d-%d", cfg.PortRangeStart, cfg.PortRangeEnd)
+	}
+
 	return cfg, nil
 }
 
@@ -59,3 +134,32 @@ func getEnvAsInt(key string, defaultValue int) int {
 
 	return value
 }
+
+// getRenamedEnvAsInt reads integer from key, falling back to its deprecated
+// name oldKey when key is unset
+func getRenamedEnvAsInt(key, oldKey string, defaultValue int) int {
+	if os.Getenv(key) == "" && os.Getenv(oldKey) != "" {
+		log.Printf("WARNING: %s is deprecated, use %s instead", oldKey, key)
+		return getEnvAsInt(oldKey, defaultValue)
+	}
+	return getEnvAsInt(key, defaultValue)
+}
+
+// getEnvAsIntList parses comma separated list of integers, e.g. "72,24,1"
+func getEnvAsIntList(key string, defaultValue []int) []int {
+	valueStr := os.Getenv(key)
+	if valueStr == "" {
+		return defaultValue
+	}
+
+	var values []int
+	for _, part := range strings.Split(valueStr, ",") {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return defaultValue
+		}
+		values = append(values, value)
+	}
+
+	return values
+}
@@ -2,10 +2,14 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 
+	"go-forward-proxy/internal/database/models"
+
 	_ "modernc.org/sqlite" // Pure Go SQLite driver (no CGO required)
 )
 
@@ -16,8 +20,9 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	// Open database connection
-	db, err := sql.Open("sqlite", dbPath)
+	// Open database connection. Busy timeout is set on every pooled
+	// connection, so concurrent writers wait for the lock instead of failing.
+	db, err := sql.Open("sqlite", dbPath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -43,5 +48,304 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, fmt.Errorf("failed to create table: %w", err)
 	}
 
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return db, nil
 }
+
+// migrate brings databases created by older versions up to date
+func migrate(db *sql.DB) error {
+	// port column: rows created before it existed keep legacy id + 10000
+	// port, as long as it fits into valid port range
+	if err := addColumnIfMissing(db, "proxies", "port", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE proxies SET port = id + 10000 WHERE port = 0 AND id + 10000 <= 65535"); err != nil {
+		return fmt.Errorf("failed to backfill port column: %w", err)
+	}
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_proxies_port ON proxies(port) WHERE port > 0"); err != nil {
+		return fmt.Errorf("failed to create port index: %w", err)
+	}
+
+	// mode column: listener protocols served on the proxy port
+	if err := addColumnIfMissing(db, "proxies", "mode", "TEXT NOT NULL DEFAULT 'http'"); err != nil {
+		return err
+	}
+
+	// username/password columns: per-proxy client credentials. Rows created
+	// before they existed are filled in by the manager on start.
+	if err := addColumnIfMissing(db, "proxies", "username", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "proxies", "password", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// Reset failure state: last provider error, failures in a row, backoff
+	// deadline and whether auto-reset gave up on the proxy
+	if err := addColumnIfMissing(db, "proxies", "last_error", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "proxies", "consecutive_failures", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "proxies", "next_attempt_at", "DATETIME"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "proxies", "reset_disabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// expires_at column: when provider key expires, NULL if unknown
+	if err := addColumnIfMissing(db, "proxies", "expires_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// next_reset_allowed_at column: provider cooldown after last rotation,
+	// NULL if unknown
+	if err := addColumnIfMissing(db, "proxies", "next_reset_allowed_at", "DATETIME"); err != nil {
+		return err
+	}
+
+	// status column: lifecycle state, "active", "paused" or "disabled"
+	if err := addColumnIfMissing(db, "proxies", "status", "TEXT NOT NULL DEFAULT 'active'"); err != nil {
+		return err
+	}
+
+	// reset_schedule column: cron schedule of resets, empty to reset every
+	// min_time_reset seconds
+	if err := addColumnIfMissing(db, "proxies", "reset_schedule", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// egress_ip column: exit IP seen through upstream at last rotation
+	if err := addColumnIfMissing(db, "proxies", "egress_ip", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// egress_error column: error of the last egress IP check, egress_ip is
+	// from an earlier check while it is set
+	if err := addColumnIfMissing(db, "proxies", "egress_error", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// ip_freshness_window column: seconds within which exit IP used before
+	// is rejected on rotation, 0 accepts any IP
+	if err := addColumnIfMissing(db, "proxies", "ip_freshness_window", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// ip_freshness_global column: compare exit IPs against all proxies
+	// instead of this one only
+	if err := addColumnIfMissing(db, "proxies", "ip_freshness_global", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+
+	// provider_options column: JSON object of provider parameters sent on
+	// every rotation, empty for provider defaults
+	if err := addColumnIfMissing(db, "proxies", "provider_options", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// proxy_socks5_str column: SOCKS5 endpoint returned by provider next to
+	// proxy_str, empty if provider has none
+	if err := addColumnIfMissing(db, "proxies", "proxy_socks5_str", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+
+	// upstream_protocol column: which provider endpoint instance dials,
+	// existing proxies keep HTTP
+	if err := addColumnIfMissing(db, "proxies", "upstream_protocol", "TEXT NOT NULL DEFAULT 'http'"); err != nil {
+		return err
+	}
+
+	// upstream/upstream_socks5 columns: provider endpoints as JSON
+	// models.Upstream. proxy_str and proxy_socks5_str are kept as display
+	// copies, rows created before are converted from them.
+	if err := addColumnIfMissing(db, "proxies", "upstream", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "proxies", "upstream_socks5", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := migrateUpstreams(db); err != nil {
+		return err
+	}
+
+	// proxy_ip_history table: egress IP checks after rotations
+	ipHistoryTableSQL := `
+	CREATE TABLE IF NOT EXISTS proxy_ip_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		proxy_id INTEGER NOT NULL,
+		proxy_str TEXT NOT NULL,
+		ip TEXT NOT NULL DEFAULT '',
+		previous_ip TEXT NOT NULL DEFAULT '',
+		changed INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		checked_at DATETIME NOT NULL
+	);`
+	if _, err := db.Exec(ipHistoryTableSQL); err != nil {
+		return fmt.Errorf("failed to create proxy_ip_history table: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_proxy_ip_history_proxy ON proxy_ip_history(proxy_id, checked_at)"); err != nil {
+		return fmt.Errorf("failed to create proxy_ip_history index: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_proxy_ip_history_checked ON proxy_ip_history(checked_at)"); err != nil {
+		return fmt.Errorf("failed to create proxy_ip_history index: %w", err)
+	}
+
+	// webhooks table: endpoints receiving proxy events, events is comma
+	// separated list (empty for all events)
+	webhooksTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);`
+	if _, err := db.Exec(webhooksTableSQL); err != nil {
+		return fmt.Errorf("failed to create webhooks table: %w", err)
+	}
+
+	// webhook_deliveries table: outbox of events queued for webhooks
+	deliveriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhook_id INTEGER NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		next_attempt_at DATETIME,
+		delivered_at DATETIME,
+		created_at DATETIME NOT NULL
+	);`
+	if _, err := db.Exec(deliveriesTableSQL); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries table: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at)"); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries index: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id)"); err != nil {
+		return fmt.Errorf("failed to create webhook_deliveries index: %w", err)
+	}
+
+	// proxy_usage table: hourly traffic rollups per proxy and username
+	usageTableSQL := `
+	CREATE TABLE IF NOT EXISTS proxy_usage (
+		proxy_id INTEGER NOT NULL,
+		username TEXT NOT NULL,
+		hour DATETIME NOT NULL,
+		bytes_up INTEGER NOT NULL DEFAULT 0,
+		bytes_down INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (proxy_id, username, hour)
+	);`
+	if _, err := db.Exec(usageTableSQL); err != nil {
+		return fmt.Errorf("failed to create proxy_usage table: %w", err)
+	}
+	if _, err := db.Exec("CREATE INDEX IF NOT EXISTS idx_proxy_usage_hour ON proxy_usage(hour)"); err != nil {
+		return fmt.Errorf("failed to create proxy_usage index: %w", err)
+	}
+
+	return nil
+}
+
+// migrateUpstreams converts colon-joined proxy strings of rows which have
+// no structured upstream yet. Rows which can't be parsed are left for the
+// manager to report when it starts them.
+func migrateUpstreams(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, proxy_str, proxy_socks5_str FROM proxies WHERE upstream = '' AND proxy_str != ''")
+	if err != nil {
+		return fmt.Errorf("failed to read proxies to migrate: %w", err)
+	}
+
+	type legacyProxy struct {
+		id                  int64
+		proxyStr, socks5Str string
+	}
+	var legacy []legacyProxy
+	for rows.Next() {
+		var p legacyProxy
+		if err := rows.Scan(&p.id, &p.proxyStr, &p.socks5Str); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan proxy to migrate: %w", err)
+		}
+		legacy = append(legacy, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read proxies to migrate: %w", err)
+	}
+
+	for _, p := range legacy {
+		upstream, err := upstreamJSON(models.UpstreamSchemeHTTP, p.proxyStr)
+		if err != nil {
+			log.Printf("WARNING: can't migrate upstream of proxy %d: %v", p.id, err)
+			continue
+		}
+		var socks5 string
+		if p.socks5Str != "" {
+			if socks5, err = upstreamJSON(models.UpstreamSchemeSOCKS5, p.socks5Str); err != nil {
+				log.Printf("WARNING: can't migrate SOCKS5 upstream of proxy %d: %v", p.id, err)
+			}
+		}
+		if _, err := db.Exec("UPDATE proxies SET upstream = ?, upstream_socks5 = ? WHERE id = ?", upstream, socks5, p.id); err != nil {
+			return fmt.Errorf("failed to migrate upstream of proxy %d: %w", p.id, err)
+		}
+	}
+
+	return nil
+}
+
+// upstreamJSON converts legacy proxy string to JSON models.Upstream
+func upstreamJSON(scheme, proxyStr string) (string, error) {
+	upstream, err := models.ParseProxyStr(scheme, proxyStr)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(upstream)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// addColumnIfMissing adds column to table unless it already exists
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("failed to scan %s schema: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read %s schema: %w", table, err)
+	}
+	rows.Close()
+
+	if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+// legacyDB returns in-memory database with proxies table as created
+// before structured upstreams, with colon-joined SOCKS5 endpoints
+func legacyDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	// Every connection of in-memory database is a separate database
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	_, err = db.Exec(`
+	CREATE TABLE proxies (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		proxy_str TEXT NOT NULL,
+		api_key TEXT NOT NULL,
+		service_type TEXT NOT NULL,
+		min_time_reset INTEGER NOT NULL,
+		last_reset_at DATETIME NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+	if err := addColumnIfMissing(db, "proxies", "proxy_socks5_str", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		t.Fatalf("add legacy SOCKS5 column: %v", err)
+	}
+	return db
+}
+
+func TestMigrateUpstreams(t *testing.T) {
+	db := legacyDB(t)
+
+	legacy := []struct {
+		proxyStr   string
+		socks5Str  string
+		want       *models.Upstream
+		wantSOCKS5 *models.Upstream
+	}{
+		{
+			proxyStr:   "203.0.113.7:8080:user:pass",
+			socks5Str:  "203.0.113.7:1080:user:pass",
+			want:       &models.Upstream{Scheme: models.UpstreamSchemeHTTP, Host: "203.0.113.7", Port: 8080, Username: "user", Password: "pass"},
+			wantSOCKS5: &models.Upstream{Scheme: models.UpstreamSchemeSOCKS5, Host: "203.0.113.7", Port: 1080, Username: "user", Password: "pass"},
+		},
+		{
+			proxyStr: "203.0.113.8:8080",
+			want:     &models.Upstream{Scheme: models.UpstreamSchemeHTTP, Host: "203.0.113.8", Port: 8080},
+		},
+		{
+			proxyStr: "203.0.113.9:8080:user:p@ss:word",
+			want:     &models.Upstream{Scheme: models.UpstreamSchemeHTTP, Host: "203.0.113.9", Port: 8080, Username: "user", Password: "p@ss:word"},
+		},
+		// Unreadable rows are left for manager to report
+		{proxyStr: "not a proxy"},
+	}
+
+	for i, row := range legacy {
+		_, err := db.Exec("INSERT INTO proxies (proxy_str, proxy_socks5_str, api_key, service_type, min_time_reset, last_reset_at) VALUES (?, ?, ?, 'tmproxy', 60, ?)",
+			row.proxyStr, row.socks5Str, fmt.Sprintf("key%d", i), time.Now())
+		if err != nil {
+			t.Fatalf("insert legacy row: %v", err)
+		}
+	}
+
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	// Migrating again leaves converted rows as they are
+	if err := migrate(db); err != nil {
+		t.Fatalf("migrate again: %v", err)
+	}
+
+	for i, row := range legacy {
+		var proxyStr, upstreamJSON, socks5JSON string
+		err := db.QueryRow("SELECT proxy_str, upstream, upstream_socks5 FROM proxies WHERE id = ?", i+1).Scan(&proxyStr, &upstreamJSON, &socks5JSON)
+		if err != nil {
+			t.Fatalf("read proxy %d: %v", i+1, err)
+		}
+		if proxyStr != row.proxyStr {
+			t.Errorf("proxy %d proxy_str = %q, want %q", i+1, proxyStr, row.proxyStr)
+		}
+
+		if row.want == nil {
+			if upstreamJSON != "" {
+				t.Errorf("proxy %d upstream = %q, want empty", i+1, upstreamJSON)
+			}
+			continue
+		}
+
+		var upstream models.Upstream
+		if err := json.Unmarshal([]byte(upstreamJSON), &upstream); err != nil {
+			t.Fatalf("proxy %d upstream %q: %v", i+1, upstreamJSON, err)
+		}
+		if !reflect.DeepEqual(&upstream, row.want) {
+			t.Errorf("proxy %d upstream = %+v, want %+v", i+1, upstream, *row.want)
+		}
+		// Display form stays what legacy row had
+		if display := upstream.String(); display != row.proxyStr {
+			t.Errorf("proxy %d upstream displays as %q, want %q", i+1, display, row.proxyStr)
+		}
+
+		if row.wantSOCKS5 == nil {
+			if socks5JSON != "" {
+				t.Errorf("proxy %d upstream_socks5 = %q, want empty", i+1, socks5JSON)
+			}
+			continue
+		}
+		var socks5 models.Upstream
+		if err := json.Unmarshal([]byte(socks5JSON), &socks5); err != nil {
+			t.Fatalf("proxy %d upstream_socks5 %q: %v", i+1, socks5JSON, err)
+		}
+		if !reflect.DeepEqual(&socks5, row.wantSOCKS5) {
+			t.Errorf("proxy %d upstream_socks5 = %+v, want %+v", i+1, socks5, *row.wantSOCKS5)
+		}
+		if display := socks5.String(); display != row.socks5Str {
+			t.Errorf("proxy %d SOCKS5 upstream displays as %q, want %q", i+1, display, row.socks5Str)
+		}
+	}
+}
@@ -6,10 +6,51 @@ import (
 
 type Proxy struct {
 	ID           uint      `json:"id"`
-	ProxyStr     string    `json:"proxy_str"`
+	ProxyStr     string    `json:"proxy_str"` // Display form of Upstream
 	APIKey       string    `json:"api_key"`
-	ServiceType  string    `json:"service_type"` // "tmproxy" or "kiotproxy"
+	ServiceType  string    `json:"service_type"`   // Registered provider, e.g. "tmproxy"
 	MinTimeReset int       `json:"min_time_reset"` // Seconds
 	LastResetAt  time.Time `json:"last_reset_at"`
 	CreatedAt    time.Time `json:"created_at"`
+	Port         int       `json:"port"`     // Listener port of the proxy instance
+	Mode         string    `json:"mode"`     // "http", "socks5" or "both"
+	Username     string    `json:"username"` // Client credentials of the proxy instance
+	Password     string    `json:"password"`
+	Status       string    `json:"status"` // "active", "paused" or "disabled"
+
+	ResetSchedule string `json:"reset_schedule"` // Cron schedule, overrides MinTimeReset when set
+	EgressIP      string `json:"egress_ip"`      // Exit IP verified after last rotation, empty if unknown
+	EgressError   string `json:"egress_error"`   // Error of last IP check, EgressIP is from an earlier one then
+
+	// Provider endpoints. UpstreamSOCKS5 is nil if provider has no SOCKS5
+	// endpoint, Upstream only for rows which couldn't be migrated.
+	Upstream         *Upstream `json:"upstream"`
+	UpstreamSOCKS5   *Upstream `json:"upstream_socks5"`
+	ProxySOCKS5Str   string    `json:"proxy_socks5_str"`  // Display form of UpstreamSOCKS5
+	UpstreamProtocol string    `json:"upstream_protocol"` // "http" or "socks5", provider endpoint the instance dials
+
+	// Exit IP used within this many seconds is rejected on rotation, 0
+	// accepts any IP. Global compares against IPs of all proxies.
+	IPFreshnessWindow int  `json:"ip_freshness_window"`
+	IPFreshnessGlobal bool `json:"ip_freshness_global"`
+
+	// Provider parameters of new proxy requests, e.g. location and ISP
+	ProviderOptions map[string]any `json:"provider_options"`
+
+	// Auto-reset failure state
+	LastError           string     `json:"last_error"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	NextAttemptAt       *time.Time `json:"next_attempt_at"` // Backoff deadline, nil when not backing off
+	ResetDisabled       bool       `json:"reset_disabled"`  // Auto-reset gave up after too many failures
+
+	ExpiresAt *time.Time `json:"expires_at"` // Provider key expiry, nil if unknown
+	Expired   bool       `json:"expired"`    // Set when ExpiresAt has passed
+
+	NextResetAllowedAt *time.Time `json:"next_reset_allowed_at"` // Provider rotation cooldown, nil if unknown
+	NextResetAt        *time.Time `json:"next_reset_at"`         // Planned auto-reset, nil if proxy is not auto-reset
+}
+
+// IsExpired reports whether provider key has expired at given time
+func (p *Proxy) IsExpired(now time.Time) bool {
+	return p.ExpiresAt != nil && !now.Before(*p.ExpiresAt)
 }
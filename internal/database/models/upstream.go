@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Dialer schemes of provider endpoints
+const (
+	UpstreamSchemeHTTP   = "http"
+	UpstreamSchemeSOCKS5 = "socks5h" // SOCKS5 resolving hostnames on upstream side
+)
+
+var ErrInvalidUpstream = errors.New("invalid upstream")
+
+// Upstream is provider endpoint proxy instance connects through
+type Upstream struct {
+	Scheme   string            `json:"scheme"` // Dialer URL scheme, e.g. "http" or "socks5h"
+	Host     string            `json:"host"`   // IP or hostname, IPv6 without brackets
+	Port     int               `json:"port"`
+	Username string            `json:"username,omitempty"`
+	Password string            `json:"password,omitempty"`
+	Params   map[string]string `json:"params,omitempty"` // Extra query parameters of dialer URL
+}
+
+// NewUpstream builds upstream from "host:port" address, IPv6 host in
+// brackets
+func NewUpstream(scheme, address, username, password string) (*Upstream, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidUpstream, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid port %q", ErrInvalidUpstream, portStr)
+	}
+
+	u := &Upstream{
+		Scheme:   scheme,
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+	}
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// ParseProxyStr parses legacy "ip:port" or "ip:port:username:password"
+// string. Password may contain colons, IPv6 host must be in brackets as
+// String writes it.
+func ParseProxyStr(scheme, proxyStr string) (*Upstream, error) {
+	var host, rest string
+	if strings.HasPrefix(proxyStr, "[") {
+		end := strings.Index(proxyStr, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("%w: expected [ipv6]:port", ErrInvalidUpstream)
+		}
+		host, rest = proxyStr[1:end], proxyStr[end+2:]
+	} else {
+		var ok bool
+		if host, rest, ok = strings.Cut(proxyStr, ":"); !ok {
+			return nil, fmt.Errorf("%w: expected ip:port or ip:port:username:password", ErrInvalidUpstream)
+		}
+	}
+
+	parts := strings.SplitN(rest, ":", 3)
+
+	var username, password string
+	switch len(parts) {
+	case 1:
+	case 3:
+		username, password = parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("%w: expected ip:port or ip:port:username:password", ErrInvalidUpstream)
+	}
+	return NewUpstream(scheme, net.JoinHostPort(host, parts[0]), username, password)
+}
+
+// Validate checks upstream can be turned into dialer URL
+func (u *Upstream) Validate() error {
+	switch {
+	case u.Scheme == "":
+		return fmt.Errorf("%w: missing scheme", ErrInvalidUpstream)
+	case u.Host == "":
+		return fmt.Errorf("%w: missing host", ErrInvalidUpstream)
+	case u.Port < 1 || u.Port > 65535:
+		return fmt.Errorf("%w: port %d out of range", ErrInvalidUpstream, u.Port)
+	}
+	return nil
+}
+
+// URL returns dialer URL of upstream
+func (u *Upstream) URL() string {
+	dialerURL := &url.URL{
+		Scheme: u.Scheme,
+		Host:   net.JoinHostPort(u.Host, strconv.Itoa(u.Port)),
+	}
+	if u.Username != "" || u.Password != "" {
+		dialerURL.User = url.UserPassword(u.Username, u.Password)
+	}
+	if len(u.Params) > 0 {
+		query := make(url.Values, len(u.Params))
+		for name, value := range u.Params {
+			query.Set(name, value)
+		}
+		dialerURL.RawQuery = query.Encode()
+	}
+	return dialerURL.String()
+}
+
+// String returns display form "host:port" or "host:port:username:password",
+// IPv6 host in brackets
+func (u *Upstream) String() string {
+	address := net.JoinHostPort(u.Host, strconv.Itoa(u.Port))
+	if u.Username == "" && u.Password == "" {
+		return address
+	}
+	return address + ":" + u.Username + ":" + u.Password
+}
@@ -3,114 +3,465 @@ package proxymanager
 import (
 	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"log"
+	"math/rand/v2"
+	"sync"
 	"time"
 
+	"go-forward-proxy/internal/config"
 	"go-forward-proxy/internal/database/models"
-	"go-forward-proxy/internal/proxyservices"
 )
 
+// autoResetMinRetryDelay is lower bound of delay after first failed reset
+const autoResetMinRetryDelay = time.Second
+
+// AutoResetService rotates proxies once their min_time_reset passes. Proxies
+// are kept in an in-memory queue ordered by next reset time, fed by manager
+// events, and resets run on a bounded worker pool.
 type AutoResetService struct {
 	manager       *Manager
 	db            *sql.DB
-	proxyServices map[string]proxyservices.ProxyService
-	checkInterval time.Duration
+	retryInterval time.Duration
+	backoffMax    time.Duration
+	maxFailures   int
+	workers       int
+	jitter        time.Duration
+	resetRequests chan uint
+
+	eventsMu     sync.Mutex
+	events       []ProxyEvent
+	eventsSignal chan struct{}
+
+	// Following fields are owned by the scheduling loop
+	queue  *resetQueue
+	states map[uint]*resetState
+}
+
+// resetState is what scheduler knows about a proxy
+type resetState struct {
+	minTimeReset  time.Duration
+	schedule      *ResetSchedule // Calendar schedule replacing minTimeReset
+	lastResetAt   time.Time
+	nextAttemptAt time.Time // Backoff deadline after failed resets
+	expiresAt     time.Time // Provider key expiry, zero if unknown
+	allowedAt     time.Time // Provider cooldown after last rotation
+	active        bool      // Proxy is not paused or disabled
+	disabled      bool      // Auto-reset gave up after failures
+	inFlight      bool
+}
+
+// dueAt returns when proxy is due by its schedule or min_time_reset
+func (s *resetState) dueAt() time.Time {
+	return dueAt(s.schedule, s.lastResetAt, s.minTimeReset)
 }
 
-func NewAutoResetService(mgr *Manager, db *sql.DB, services map[string]proxyservices.ProxyService, checkInterval int) *AutoResetService {
-	return &AutoResetService{
+func (s *resetState) expired(now time.Time) bool {
+	return !s.expiresAt.IsZero() && !now.Before(s.expiresAt)
+}
+
+type resetJob struct {
+	proxyID uint
+	early   bool
+}
+
+type resetResult struct {
+	job resetJob
+	// proxy is state after the job, nil if proxy no longer exists
+	proxy *models.Proxy
+	// retryAt is set when job could not load proxy and should run again
+	retryAt time.Time
+}
+
+func NewAutoResetService(mgr *Manager, db *sql.DB, cfg *config.Config) *AutoResetService {
+	workers := cfg.AutoResetWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	// Zero delay would retry failing provider in a tight loop forever
+	retryInterval := max(time.Duration(cfg.AutoResetRetryDelay)*time.Second, autoResetMinRetryDelay)
+	ars := &AutoResetService{
 		manager:       mgr,
 		db:            db,
-		proxyServices: services,
-		checkInterval: time.Duration(checkInterval) * time.Second,
+		retryInterval: retryInterval,
+		backoffMax:    max(time.Duration(cfg.AutoResetBackoffMax)*time.Second, retryInterval),
+		maxFailures:   cfg.AutoResetMaxFailures,
+		workers:       workers,
+		jitter:        time.Duration(cfg.AutoResetJitter) * time.Second,
+		resetRequests: make(chan uint, 64),
+		eventsSignal:  make(chan struct{}, 1),
+		queue:         newResetQueue(),
+		states:        make(map[uint]*resetState),
+	}
+	mgr.Subscribe(ars.handleEvent)
+	return ars
+}
+
+// handleEvent queues manager event for the scheduling loop. It never
+// blocks, so manager is not held up while loop is busy or not running.
+func (ars *AutoResetService) handleEvent(event ProxyEvent) {
+	ars.eventsMu.Lock()
+	ars.events = append(ars.events, event)
+	ars.eventsMu.Unlock()
+
+	select {
+	case ars.eventsSignal <- struct{}{}:
+	default:
+	}
+}
+
+// RequestReset asks the service to rotate proxy early, e.g. when its
+// upstream is unhealthy or keeps failing client requests. The request is
+// dropped if the queue is full.
+func (ars *AutoResetService) RequestReset(proxyID uint) {
+	select {
+	case ars.resetRequests <- proxyID:
+	default:
+		log.Printf("Reset request queue is full, dropping request for proxy %d", proxyID)
 	}
 }
 
 func (ars *AutoResetService) Start(ctx context.Context) {
-	ticker := time.NewTicker(ars.checkInterval)
-	defer ticker.Stop()
+	if err := ars.loadProxies(); err != nil {
+		log.Printf("Failed to load proxies: %v", err)
+	}
+
+	jobs := make(chan resetJob, ars.workers)
+	results := make(chan resetResult, ars.workers)
+	for i := 0; i < ars.workers; i++ {
+		go ars.worker(ctx, jobs, results)
+	}
+	defer close(jobs)
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
 
-	log.Printf("AutoResetService started with check interval: %v", ars.checkInterval)
+	log.Printf("AutoResetService started with %d worker(s), jitter: %v, retry backoff: %v-%v", ars.workers, ars.jitter, ars.retryInterval, ars.backoffMax)
 
+	busy := 0
 	for {
+		busy += ars.dispatchDue(jobs, ars.workers-busy)
+
+		// Wait for next due proxy only while there is a free worker
+		var due <-chan time.Time
+		if next := ars.queue.peek(); next != nil && busy < ars.workers {
+			timer.Reset(time.Until(next.at))
+			due = timer.C
+		}
+
 		select {
 		case <-ctx.Done():
 			log.Println("AutoResetService stopped")
 			return
-		case <-ticker.C:
-			ars.checkAndResetProxies()
+		case <-due:
+		case <-ars.eventsSignal:
+			ars.applyEvents()
+		case proxyID := <-ars.resetRequests:
+			ars.requestEarly(proxyID)
+		case result := <-results:
+			busy--
+			ars.applyResult(result)
 		}
 	}
 }
 
-func (ars *AutoResetService) checkAndResetProxies() {
-	// Query all proxies
-	rows, err := ars.db.Query(`
-		SELECT id, proxy_str, api_key, service_type, min_time_reset, last_reset_at, created_at
-		FROM proxies
-	`)
+// loadProxies schedules all proxies stored in database
+func (ars *AutoResetService) loadProxies() error {
+	rows, err := ars.db.Query(`SELECT ` + proxyColumns + ` FROM proxies`)
 	if err != nil {
-		log.Printf("Failed to load proxies: %v", err)
-		return
+		return err
 	}
 	defer rows.Close()
 
-	var proxies []models.Proxy
 	for rows.Next() {
-		var p models.Proxy
-		if err := rows.Scan(&p.ID, &p.ProxyStr, &p.APIKey, &p.ServiceType, &p.MinTimeReset, &p.LastResetAt, &p.CreatedAt); err != nil {
+		p, err := scanProxy(rows)
+		if err != nil {
 			log.Printf("Failed to scan proxy: %v", err)
 			continue
 		}
-		proxies = append(proxies, p)
+		ars.track(&p)
+	}
+
+	return rows.Err()
+}
+
+// track updates scheduler state of proxy and schedules its next reset
+func (ars *AutoResetService) track(proxy *models.Proxy) {
+	state, ok := ars.states[proxy.ID]
+	if !ok {
+		state = &resetState{}
+		ars.states[proxy.ID] = state
+	}
+	state.minTimeReset = time.Duration(proxy.MinTimeReset) * time.Second
+	state.schedule = proxySchedule(proxy)
+	state.lastResetAt = proxy.LastResetAt
+	state.nextAttemptAt = time.Time{}
+	if proxy.NextAttemptAt != nil {
+		state.nextAttemptAt = *proxy.NextAttemptAt
+	}
+	state.expiresAt = time.Time{}
+	if proxy.ExpiresAt != nil {
+		state.expiresAt = *proxy.ExpiresAt
+	}
+	state.allowedAt = time.Time{}
+	if proxy.NextResetAllowedAt != nil {
+		state.allowedAt = *proxy.NextResetAllowedAt
+	}
+	state.active = proxy.Status == StatusActive
+	state.disabled = proxy.ResetDisabled
+
+	// Running job reschedules proxy when it finishes
+	if state.inFlight {
+		return
+	}
+	// Paused proxies are not rotated until resumed, expired keys until
+	// proxy is updated with a valid key
+	if !state.active || state.disabled || state.expired(time.Now()) {
+		ars.queue.remove(proxy.ID)
+		return
+	}
+	ars.queue.schedule(proxy.ID, ars.nextResetAt(state))
+}
+
+// nextResetAt returns reset time of proxy spread by random jitter, so
+// proxies created together don't hit provider APIs in the same second.
+// Proxy which is backing off after failures waits until its backoff ends,
+// and no proxy is rotated before provider cooldown passes.
+func (ars *AutoResetService) nextResetAt(state *resetState) time.Time {
+	at := state.dueAt()
+	if ars.jitter > 0 {
+		at = at.Add(rand.N(ars.jitter))
+	}
+	if at.Before(state.nextAttemptAt) {
+		at = state.nextAttemptAt
+	}
+	if at.Before(state.allowedAt) {
+		at = state.allowedAt
+	}
+	return at
+}
+
+// backoff returns delay before next attempt after given number of
+// consecutive failures: retry interval doubled per failure, up to cap
+func (ars *AutoResetService) backoff(failures int) time.Duration {
+	delay := ars.retryInterval
+	for i := 1; i < failures && delay < ars.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > ars.backoffMax {
+		delay = ars.backoffMax
+	}
+	return delay
+}
+
+func (ars *AutoResetService) forget(proxyID uint) {
+	ars.queue.remove(proxyID)
+	delete(ars.states, proxyID)
+}
+
+func (ars *AutoResetService) applyEvents() {
+	ars.eventsMu.Lock()
+	events := ars.events
+	ars.events = nil
+	ars.eventsMu.Unlock()
+
+	for _, event := range events {
+		switch event.Kind {
+		case ProxyCreated, ProxyUpdated:
+			ars.track(event.Proxy)
+		case ProxyDeleted:
+			ars.forget(event.ProxyID)
+		}
 	}
+}
 
+// requestEarly moves proxy to the front of the queue if provider cooldown
+// allows it to be rotated now
+func (ars *AutoResetService) requestEarly(proxyID uint) {
+	state, ok := ars.states[proxyID]
+	if !ok || state.inFlight || !state.active || state.disabled {
+		return
+	}
+	if time.Now().Before(state.allowedAt) {
+		log.Printf("Early reset of proxy %d postponed, provider cooldown lasts until %s", proxyID, state.allowedAt.Format(time.RFC3339))
+		return
+	}
+	if state.expired(time.Now()) {
+		log.Printf("Early reset of proxy %d skipped, provider key expired at %s", proxyID, state.expiresAt.Format(time.RFC3339))
+		return
+	}
+	if time.Now().Before(state.nextAttemptAt) {
+		log.Printf("Early reset of proxy %d postponed, backing off after failures until %s", proxyID, state.nextAttemptAt.Format(time.RFC3339))
+		return
+	}
+
+	log.Printf("Proxy %d needs early reset", proxyID)
+	ars.queue.schedule(proxyID, time.Now())
+}
+
+// dispatchDue hands proxies which are due to at most limit workers and
+// returns number of dispatched jobs
+func (ars *AutoResetService) dispatchDue(jobs chan<- resetJob, limit int) int {
 	now := time.Now()
+	dispatched := 0
 
-	for _, proxy := range proxies {
-		elapsed := now.Sub(proxy.LastResetAt).Seconds()
+	for dispatched < limit {
+		next := ars.queue.peek()
+		if next == nil || next.at.After(now) {
+			break
+		}
+		ars.queue.pop()
 
-		if elapsed >= float64(proxy.MinTimeReset) {
-			log.Printf("Proxy %d needs reset (elapsed: %.0fs, min: %ds)", proxy.ID, elapsed, proxy.MinTimeReset)
+		state, ok := ars.states[next.proxyID]
+		if !ok {
+			continue
+		}
+		state.inFlight = true
 
-			if err := ars.resetProxy(&proxy, now); err != nil {
-				log.Printf("Failed to reset proxy %d: %v", proxy.ID, err)
-			} else {
-				log.Printf("Proxy %d reset successfully", proxy.ID)
-			}
+		jobs <- resetJob{
+			proxyID: next.proxyID,
+			early:   now.Before(state.dueAt()),
 		}
+		dispatched++
 	}
+
+	return dispatched
 }
 
-func (ars *AutoResetService) resetProxy(proxy *models.Proxy, resetTime time.Time) error {
-	// Get service
-	service, ok := ars.proxyServices[proxy.ServiceType]
+func (ars *AutoResetService) applyResult(result resetResult) {
+	proxyID := result.job.proxyID
+
+	state, ok := ars.states[proxyID]
 	if !ok {
-		return fmt.Errorf("unknown service type: %s", proxy.ServiceType)
+		// Deleted while job was running
+		return
 	}
+	state.inFlight = false
 
-	// Get new proxy
-	proxyInfo, err := service.GetNewProxy(proxy.APIKey)
-	if err != nil {
-		return fmt.Errorf("failed to get new proxy: %w", err)
+	// Job learned nothing new about proxy, keep what events told us
+	if !result.retryAt.IsZero() {
+		if state.active && !state.disabled && !state.expired(time.Now()) {
+			ars.queue.schedule(proxyID, result.retryAt)
+		}
+		return
 	}
 
-	// Update database
-	_, err = ars.db.Exec(`
-		UPDATE proxies
-		SET proxy_str = ?, last_reset_at = ?
-		WHERE id = ?
-	`, proxyInfo.ProxyStr, resetTime, proxy.ID)
+	if result.proxy == nil {
+		ars.forget(proxyID)
+		return
+	}
+
+	ars.track(result.proxy)
+}
 
+// worker runs jobs until jobs channel is closed. Provider calls of running
+// job are cancelled when ctx is done.
+func (ars *AutoResetService) worker(ctx context.Context, jobs <-chan resetJob, results chan<- resetResult) {
+	for job := range jobs {
+		results <- ars.runJob(ctx, job)
+	}
+}
+
+func (ars *AutoResetService) runJob(ctx context.Context, job resetJob) resetResult {
+	result := resetResult{job: job}
+
+	// Wait for rotation of the proxy through API or in-band control, due
+	// time below is checked against its result
+	requestedAt := time.Now()
+	unlock, err := ars.manager.lockRotation(ctx, job.proxyID)
 	if err != nil {
-		return fmt.Errorf("failed to update database: %w", err)
+		result.retryAt = time.Now().Add(ars.retryInterval)
+		return result
+	}
+	defer unlock()
+
+	proxy, err := ars.manager.GetProxyByID(job.proxyID)
+	if err != nil {
+		if !errors.Is(err, ErrProxyNotFound) {
+			// Keep proxy scheduled, database may be available again later
+			log.Printf("Failed to load proxy %d: %v", job.proxyID, err)
+			result.retryAt = time.Now().Add(ars.retryInterval)
+		}
+		return result
 	}
+	result.proxy = proxy
 
-	// Update running instance
-	if err := ars.manager.UpdateInstance(proxy.ID, proxyInfo.ProxyStr); err != nil {
-		return fmt.Errorf("failed to update instance: %w", err)
+	if proxy.Status != StatusActive || proxy.ResetDisabled {
+		return result
 	}
 
-	return nil
+	now := time.Now()
+	if proxy.IsExpired(now) {
+		log.Printf("Proxy %d not reset, provider key expired at %s", proxy.ID, proxy.ExpiresAt.Format(time.RFC3339))
+		return result
+	}
+
+	elapsed := now.Sub(proxy.LastResetAt)
+	due := dueAt(proxySchedule(proxy), proxy.LastResetAt, time.Duration(proxy.MinTimeReset)*time.Second)
+
+	switch {
+	case proxy.LastResetAt.After(requestedAt):
+		// Proxy was rotated while job waited for the guard
+		return result
+	case job.early:
+		log.Printf("Resetting proxy %d early (elapsed: %.0fs, min: %ds)", proxy.ID, elapsed.Seconds(), proxy.MinTimeReset)
+	case now.Before(due):
+		// Proxy was rotated since it was scheduled
+		return result
+	case proxy.ResetSchedule != "":
+		log.Printf("Proxy %d needs reset (elapsed: %.0fs, schedule: %s)", proxy.ID, elapsed.Seconds(), proxy.ResetSchedule)
+	default:
+		log.Printf("Proxy %d needs reset (elapsed: %.0fs, min: %ds)", proxy.ID, elapsed.Seconds(), proxy.MinTimeReset)
+	}
+
+	previousIP := proxy.EgressIP
+	if err := ars.manager.rotateUpstream(ctx, proxy); err != nil {
+		// Shutdown is not failure of provider
+		if ctx.Err() != nil {
+			log.Printf("Reset of proxy %d cancelled: %v", proxy.ID, err)
+			return result
+		}
+		ars.recordFailure(proxy, err, now)
+		ars.manager.notifyRotationFailed(proxy, err)
+		return result
+	}
+
+	// Proxy is rotated at this point, instance which is not running picks
+	// new upstream up when it is started
+	if err := ars.manager.UpdateInstance(proxy); err != nil {
+		log.Printf("Proxy %d reset, but failed to update instance: %v", proxy.ID, err)
+	} else {
+		log.Printf("Proxy %d reset successfully", proxy.ID)
+	}
+
+	ars.manager.verifyEgress(ctx, proxy)
+	ars.manager.notifyRotated(proxy, previousIP)
+	return result
+}
+
+// recordFailure persists failed reset and backs proxy off exponentially.
+// After too many failures in a row auto-reset is disabled for the proxy.
+func (ars *AutoResetService) recordFailure(proxy *models.Proxy, resetErr error, now time.Time) {
+	proxy.LastError = resetErr.Error()
+	proxy.ConsecutiveFailures++
+
+	proxy.ResetDisabled = ars.maxFailures > 0 && proxy.ConsecutiveFailures >= ars.maxFailures
+
+	if proxy.ResetDisabled {
+		proxy.NextAttemptAt = nil
+		log.Printf("Failed to reset proxy %d (%d in a row), auto-reset disabled: %v", proxy.ID, proxy.ConsecutiveFailures, resetErr)
+	} else {
+		nextAttemptAt := now.Add(ars.backoff(proxy.ConsecutiveFailures))
+		proxy.NextAttemptAt = &nextAttemptAt
+		log.Printf("Failed to reset proxy %d (%d in a row), next attempt at %s: %v", proxy.ID, proxy.ConsecutiveFailures, nextAttemptAt.Format(time.RFC3339), resetErr)
+	}
+
+	_, err := ars.db.Exec(`
+		UPDATE proxies
+		SET last_error = ?, consecutive_failures = ?, next_attempt_at = ?, reset_disabled = ?
+		WHERE id = ?
+	`, proxy.LastError, proxy.ConsecutiveFailures, proxy.NextAttemptAt, proxy.ResetDisabled, proxy.ID)
+	if err != nil {
+		log.Printf("Failed to save reset failure of proxy %d: %v", proxy.ID, err)
+	}
 }
@@ -0,0 +1,273 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-forward-proxy/pkg/dumbproxy/handler"
+
+	"github.com/things-go/go-socks5"
+)
+
+// Connection protocols reported in connection registry
+const (
+	ProtocolHTTP    = "http"
+	ProtocolConnect = "connect"
+	ProtocolSOCKS5  = "socks5"
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not found")
+	ErrRegistryClosed     = errors.New("proxy is shutting down")
+)
+
+// drainPollInterval is how often drain checks for remaining connections
+const drainPollInterval = 100 * time.Millisecond
+
+// ConnectionInfo is a snapshot of a connection served by proxy instance
+type ConnectionInfo struct {
+	ID          uint64    `json:"id"`
+	ClientAddr  string    `json:"client_addr"`
+	Username    string    `json:"username"`
+	Destination string    `json:"destination"`
+	Protocol    string    `json:"protocol"`
+	StartedAt   time.Time `json:"started_at"`
+	BytesUp     int64     `json:"bytes_up"`   // Client to destination
+	BytesDown   int64     `json:"bytes_down"` // Destination to client
+}
+
+type clientInfoKey struct{}
+
+// clientInfo carries client details from listener into forward function
+type clientInfo struct {
+	addr     string
+	protocol string
+	// closer closes client connection when forward function can't do it
+	// itself (SOCKS5 incoming stream is not closable)
+	closer io.Closer
+}
+
+func clientInfoToContext(ctx context.Context, info clientInfo) context.Context {
+	return context.WithValue(ctx, clientInfoKey{}, info)
+}
+
+func clientInfoFromContext(ctx context.Context) clientInfo {
+	info, _ := ctx.Value(clientInfoKey{}).(clientInfo)
+	return info
+}
+
+// withHTTPClientInfo records client address and protocol of HTTP requests
+func withHTTPClientInfo(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		protocol := ProtocolHTTP
+		if req.Method == "CONNECT" {
+			protocol = ProtocolConnect
+		}
+		ctx := clientInfoToContext(req.Context(), clientInfo{
+			addr:     req.RemoteAddr,
+			protocol: protocol,
+		})
+		next.ServeHTTP(wr, req.WithContext(ctx))
+	})
+}
+
+// withSOCKSClientInfo records client address of SOCKS5 requests
+func withSOCKSClientInfo(next func(ctx context.Context, writer io.Writer, request *socks5.Request) error) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		info := clientInfo{
+			protocol: ProtocolSOCKS5,
+		}
+		if request.RemoteAddr != nil {
+			info.addr = request.RemoteAddr.String()
+		}
+		if closer, ok := writer.(io.Closer); ok {
+			info.closer = closer
+		}
+		return next(clientInfoToContext(ctx, info), writer, request)
+	}
+}
+
+type connEntry struct {
+	info      ConnectionInfo
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	cancel    context.CancelFunc
+	closer    io.Closer
+}
+
+func (e *connEntry) kill() {
+	e.cancel()
+	if e.closer != nil {
+		e.closer.Close()
+	}
+}
+
+func (e *connEntry) snapshot() ConnectionInfo {
+	info := e.info
+	info.BytesUp = e.bytesUp.Load()
+	info.BytesDown = e.bytesDown.Load()
+	return info
+}
+
+// connRegistry tracks connections forwarded by a proxy instance
+type connRegistry struct {
+	mu     sync.Mutex
+	nextID uint64
+	conns  map[uint64]*connEntry
+	// closed is set once registry was drained, new connections are refused
+	closed bool
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[uint64]*connEntry),
+	}
+}
+
+// wrap returns forward function which registers every forwarded
+// connection for its lifetime and makes it killable
+func (r *connRegistry) wrap(next handler.ForwardFunc) handler.ForwardFunc {
+	return func(ctx context.Context, username string, incoming, outgoing io.ReadWriteCloser, network, address string) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		client := clientInfoFromContext(ctx)
+		entry := &connEntry{
+			info: ConnectionInfo{
+				ClientAddr:  client.addr,
+				Username:    username,
+				Destination: address,
+				Protocol:    client.protocol,
+				StartedAt:   time.Now(),
+			},
+			cancel: cancel,
+			closer: client.closer,
+		}
+
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			incoming.Close()
+			outgoing.Close()
+			return ErrRegistryClosed
+		}
+		r.nextID++
+		entry.info.ID = r.nextID
+		r.conns[entry.info.ID] = entry
+		r.mu.Unlock()
+
+		defer func() {
+			r.mu.Lock()
+			delete(r.conns, entry.info.ID)
+			r.mu.Unlock()
+		}()
+
+		return next(
+			ctx,
+			username,
+			&countingStream{ReadWriteCloser: incoming, read: &entry.bytesUp},
+			&countingStream{ReadWriteCloser: outgoing, read: &entry.bytesDown},
+			network,
+			address,
+		)
+	}
+}
+
+// List returns snapshot of active connections ordered by ID
+func (r *connRegistry) List() []ConnectionInfo {
+	r.mu.Lock()
+	entries := make([]*connEntry, 0, len(r.conns))
+	for _, entry := range r.conns {
+		entries = append(entries, entry)
+	}
+	r.mu.Unlock()
+
+	conns := make([]ConnectionInfo, 0, len(entries))
+	for _, entry := range entries {
+		conns = append(conns, entry.snapshot())
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ID < conns[j].ID
+	})
+	return conns
+}
+
+// Kill terminates connection with given ID
+func (r *connRegistry) Kill(id uint64) error {
+	r.mu.Lock()
+	entry, ok := r.conns[id]
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrConnectionNotFound
+	}
+
+	entry.kill()
+	return nil
+}
+
+// Drain waits until all connections finish or ctx is done, then
+// force-closes remaining ones and refuses new ones. Returns number of
+// connections which were force-closed.
+func (r *connRegistry) Drain(ctx context.Context) int {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for r.count() > 0 {
+		select {
+		case <-ctx.Done():
+			return r.closeAll()
+		case <-ticker.C:
+		}
+	}
+
+	return r.closeAll()
+}
+
+func (r *connRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// closeAll force-closes all connections and returns their number
+func (r *connRegistry) closeAll() int {
+	r.mu.Lock()
+	r.closed = true
+	entries := make([]*connEntry, 0, len(r.conns))
+	for _, entry := range r.conns {
+		entries = append(entries, entry)
+	}
+	r.mu.Unlock()
+
+	for _, entry := range entries {
+		entry.kill()
+	}
+	return len(entries)
+}
+
+// countingStream counts bytes read from the wrapped stream
+type countingStream struct {
+	io.ReadWriteCloser
+	read *atomic.Int64
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	s.read.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite preserves half-close semantics of the wrapped stream
+func (s *countingStream) CloseWrite() error {
+	if cw, ok := s.ReadWriteCloser.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return s.Close()
+}
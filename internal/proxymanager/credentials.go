@@ -0,0 +1,121 @@
+package proxymanager
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+
+	"go-forward-proxy/pkg/dumbproxy/auth"
+	clog "go-forward-proxy/pkg/dumbproxy/log"
+
+	"github.com/things-go/go-socks5"
+)
+
+const (
+	credentialAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	usernameLength     = 10
+	passwordLength     = 20
+)
+
+// GenerateCredentials returns random username and password for proxy clients
+func GenerateCredentials() (string, string, error) {
+	username, err := randomString(usernameLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	password, err := randomString(passwordLength)
+	if err != nil {
+		return "", "", err
+	}
+
+	return username, password, nil
+}
+
+func randomString(length int) (string, error) {
+	max := big.NewInt(int64(len(credentialAlphabet)))
+	buf := make([]byte, length)
+	for i := range buf {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate random string: %w", err)
+		}
+		buf[i] = credentialAlphabet[n.Int64()]
+	}
+	return string(buf), nil
+}
+
+// newStaticAuth builds dumbproxy static auth for a single username/password
+func newStaticAuth(username, password string, logger *clog.CondLogger) (auth.Auth, error) {
+	params := url.Values{}
+	params.Set("username", username)
+	params.Set("password", password)
+	return auth.NewAuth("static://?"+params.Encode(), logger)
+}
+
+// proxyBasicAuth returns username and password from Proxy-Authorization
+// header of the request
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	parts := strings.SplitN(req.Header.Get("Proxy-Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "basic") {
+		return "", "", false
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", "", false
+	}
+
+	pair := strings.SplitN(string(data), ":", 2)
+	if len(pair) != 2 {
+		return "", "", false
+	}
+	return pair[0], pair[1], true
+}
+
+func basicAuthToken(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// swapAuth is an auth provider which can be replaced atomically while the
+// proxy is serving, so credentials rotate without restarting listener.
+// Tunnels which are already established are not affected.
+type swapAuth struct {
+	current atomic.Pointer[auth.Auth]
+}
+
+func newSwapAuth(a auth.Auth) *swapAuth {
+	sa := &swapAuth{}
+	sa.current.Store(&a)
+	return sa
+}
+
+func (sa *swapAuth) Validate(ctx context.Context, wr http.ResponseWriter, req *http.Request) (string, bool) {
+	return (*sa.current.Load()).Validate(ctx, wr, req)
+}
+
+// Valid implements socks5.CredentialStore
+func (sa *swapAuth) Valid(user, password, userAddr string) bool {
+	if cs, ok := (*sa.current.Load()).(socks5.CredentialStore); ok {
+		return cs.Valid(user, password, userAddr)
+	}
+	return false
+}
+
+// Swap replaces auth provider and closes the previous one
+func (sa *swapAuth) Swap(a auth.Auth) {
+	old := sa.current.Swap(&a)
+	if old != nil {
+		(*old).Close()
+	}
+}
+
+func (sa *swapAuth) Close() error {
+	return (*sa.current.Load()).Close()
+}
@@ -0,0 +1,274 @@
+package proxymanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+	"go-forward-proxy/pkg/dumbproxy/dialer"
+)
+
+// maxIPResponseSize limits body read from IP echo service
+const maxIPResponseSize = 256
+
+// egressPruneInterval is how often old IP history is deleted
+const egressPruneInterval = time.Hour
+
+// IPHistoryEntry is egress IP seen through proxy after it was rotated
+type IPHistoryEntry struct {
+	ID         int64     `json:"id"`
+	ProxyID    uint      `json:"proxy_id"`
+	ProxyStr   string    `json:"proxy_str"`   // Upstream the IP was checked through
+	IP         string    `json:"ip"`          // Empty if check failed
+	PreviousIP string    `json:"previous_ip"` // Egress IP before rotation, empty if unknown
+	Changed    bool      `json:"changed"`
+	Error      string    `json:"error,omitempty"`
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// EgressVerifier fetches IP echo URL through upstream of a proxy to find
+// out its egress IP, and keeps history of IPs seen after rotations
+type EgressVerifier struct {
+	db        *sql.DB
+	url       string
+	timeout   time.Duration
+	retention time.Duration
+
+	pruneMu   sync.Mutex
+	lastPrune time.Time
+}
+
+func NewEgressVerifier(db *sql.DB, url string, timeout, retentionDays int) *EgressVerifier {
+	return &EgressVerifier{
+		db:        db,
+		url:       url,
+		timeout:   time.Duration(timeout) * time.Second,
+		retention: time.Duration(retentionDays) * 24 * time.Hour,
+	}
+}
+
+// Verify checks egress IP of proxy's current upstream and records it.
+// Check failures are recorded too, so history shows upstreams which
+// didn't work.
+func (ev *EgressVerifier) Verify(ctx context.Context, proxy *models.Proxy) (IPHistoryEntry, error) {
+	entry := IPHistoryEntry{
+		ProxyID:    proxy.ID,
+		ProxyStr:   proxy.ProxyStr,
+		PreviousIP: proxy.EgressIP,
+		CheckedAt:  time.Now(),
+	}
+
+	upstream, err := proxyUpstream(proxy)
+	var ip string
+	if err == nil {
+		entry.ProxyStr = upstream.String()
+		ip, err = ev.lookup(ctx, upstream.URL())
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.IP = ip
+		entry.Changed = ip != proxy.EgressIP
+	}
+
+	err = ev.record(&entry)
+	return entry, err
+}
+
+// record saves IP check into history
+func (ev *EgressVerifier) record(entry *IPHistoryEntry) error {
+	result, err := ev.db.Exec(`
+		INSERT INTO proxy_ip_history (proxy_id, proxy_str, ip, previous_ip, changed, error, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, entry.ProxyID, entry.ProxyStr, entry.IP, entry.PreviousIP, entry.Changed, entry.Error, entry.CheckedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save IP history: %w", err)
+	}
+	entry.ID, _ = result.LastInsertId()
+
+	ev.pruneIfDue()
+	return nil
+}
+
+// usedSince reports whether IP was seen as egress IP of proxy, or of any
+// proxy when global is set, since given time
+func (ev *EgressVerifier) usedSince(ip string, proxyID uint, global bool, since time.Time) (bool, error) {
+	query := "SELECT COUNT(*) FROM proxy_ip_history WHERE ip = ? AND checked_at >= ?"
+	args := []any{ip, since}
+	if !global {
+		query += " AND proxy_id = ?"
+		args = append(args, proxyID)
+	}
+
+	var count int
+	if err := ev.db.QueryRow(query, args...).Scan(&count); err != nil {
+		return false, fmt.Errorf("failed to query IP history: %w", err)
+	}
+	return count > 0, nil
+}
+
+// lookup fetches IP echo URL through a fresh dialer of given upstream URL
+func (ev *EgressVerifier) lookup(ctx context.Context, upstreamURL string) (string, error) {
+	upstream, err := dialer.ProxyDialerFromURL(upstreamURL, &net.Dialer{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create upstream dialer: %w", err)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext:       upstream.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ev.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ev.url, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch IP through upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("IP check returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxIPResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("failed to read IP check response: %w", err)
+	}
+
+	ip := strings.TrimSpace(string(body))
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("IP check returned invalid IP: %q", ip)
+	}
+	return ip, nil
+}
+
+// pruneIfDue deletes history older than retention period, at most once
+// per prune interval
+func (ev *EgressVerifier) pruneIfDue() {
+	if ev.retention <= 0 {
+		return
+	}
+
+	ev.pruneMu.Lock()
+	if time.Since(ev.lastPrune) < egressPruneInterval {
+		ev.pruneMu.Unlock()
+		return
+	}
+	ev.lastPrune = time.Now()
+	ev.pruneMu.Unlock()
+
+	cutoff := time.Now().Add(-ev.retention)
+	if _, err := ev.db.Exec("DELETE FROM proxy_ip_history WHERE checked_at < ?", cutoff); err != nil {
+		log.Printf("Failed to prune IP history: %v", err)
+	}
+}
+
+// History returns latest IP checks of proxy, newest first
+func (ev *EgressVerifier) History(proxyID uint, limit int) ([]IPHistoryEntry, error) {
+	rows, err := ev.db.Query(`
+		SELECT id, proxy_id, proxy_str, ip, previous_ip, changed, error, checked_at
+		FROM proxy_ip_history
+		WHERE proxy_id = ?
+		ORDER BY checked_at DESC, id DESC
+		LIMIT ?
+	`, proxyID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query IP history: %w", err)
+	}
+	defer rows.Close()
+
+	history := []IPHistoryEntry{}
+	for rows.Next() {
+		var entry IPHistoryEntry
+		if err := rows.Scan(&entry.ID, &entry.ProxyID, &entry.ProxyStr, &entry.IP, &entry.PreviousIP, &entry.Changed, &entry.Error, &entry.CheckedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan IP history: %w", err)
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// SetEgressVerifier sets verifier checking egress IP of proxies after
+// rotation. Without it rotations are not verified.
+func (m *Manager) SetEgressVerifier(ev *EgressVerifier) {
+	m.egress = ev
+}
+
+// verifyEgress checks egress IP of freshly rotated proxy and saves it as
+// proxy's current egress IP. Must not be called while holding m.mu, the
+// check goes over network.
+func (m *Manager) verifyEgress(ctx context.Context, proxy *models.Proxy) {
+	if m.egress == nil {
+		return
+	}
+
+	entry, err := m.egress.Verify(ctx, proxy)
+	if err != nil {
+		log.Printf("Failed to record egress IP of proxy %d: %v", proxy.ID, err)
+	}
+
+	// Failed check keeps last known egress IP, failure is saved next to it
+	if entry.Error != "" {
+		log.Printf("WARNING: egress IP check of proxy %d through %s failed: %s", proxy.ID, entry.ProxyStr, entry.Error)
+		if _, err := m.db.Exec("UPDATE proxies SET egress_error = ? WHERE id = ?", entry.Error, proxy.ID); err != nil {
+			log.Printf("Failed to save egress IP check error of proxy %d: %v", proxy.ID, err)
+			return
+		}
+		proxy.EgressError = entry.Error
+		return
+	}
+
+	if !entry.Changed {
+		log.Printf("WARNING: proxy %d kept egress IP %s after rotation", proxy.ID, entry.IP)
+	} else {
+		log.Printf("Proxy %d egress IP: %s (previous: %s)", proxy.ID, entry.IP, entry.PreviousIP)
+	}
+
+	if _, err := m.db.Exec("UPDATE proxies SET egress_ip = ?, egress_error = '' WHERE id = ?", entry.IP, proxy.ID); err != nil {
+		log.Printf("Failed to save egress IP of proxy %d: %v", proxy.ID, err)
+		return
+	}
+	proxy.EgressIP = entry.IP
+	proxy.EgressError = ""
+}
+
+// verifyEgressInBackground checks egress IP of proxy without holding up
+// the caller. Proxy is copied, so caller may keep using it.
+func (m *Manager) verifyEgressInBackground(proxy *models.Proxy) {
+	if m.egress == nil {
+		return
+	}
+
+	snapshot := *proxy
+	go m.verifyEgress(m.ctx, &snapshot)
+}
+
+// ProxyIPHistory returns latest egress IP checks of proxy, newest first
+func (m *Manager) ProxyIPHistory(id uint, limit int) ([]IPHistoryEntry, error) {
+	if _, err := m.GetProxyByID(id); err != nil {
+		return nil, err
+	}
+	if m.egress == nil {
+		return []IPHistoryEntry{}, nil
+	}
+
+	return m.egress.History(id, limit)
+}
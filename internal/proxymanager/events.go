@@ -0,0 +1,58 @@
+package proxymanager
+
+import (
+	"go-forward-proxy/internal/database/models"
+)
+
+// ProxyEventKind is type of proxy lifecycle event
+type ProxyEventKind string
+
+const (
+	ProxyCreated ProxyEventKind = "created"
+	ProxyUpdated ProxyEventKind = "updated"
+	ProxyDeleted ProxyEventKind = "deleted"
+
+	// Notifications which don't change scheduling state of proxy
+	ProxyRotated        ProxyEventKind = "rotated"
+	ProxyRotationFailed ProxyEventKind = "rotation_failed"
+	ProxyExpired        ProxyEventKind = "expired"
+	ProxyHealthDegraded ProxyEventKind = "health_degraded"
+)
+
+// ProxyEvent describes change of a proxy made through manager. Proxy holds
+// state after the change and is nil for deleted proxies.
+type ProxyEvent struct {
+	Kind    ProxyEventKind
+	ProxyID uint
+	Proxy   *models.Proxy
+
+	PreviousIP string // Egress IP before rotation, set for rotated events
+	Error      string // Set for rotation failed and health degraded events
+}
+
+// Subscribe registers fn to receive proxy events. fn is called
+// synchronously by the goroutine making the change, sometimes with manager
+// lock held, so it must not block or take manager lock.
+func (m *Manager) Subscribe(fn func(ProxyEvent)) {
+	m.subscribersMu.Lock()
+	defer m.subscribersMu.Unlock()
+	m.subscribers = append(m.subscribers, fn)
+}
+
+func (m *Manager) emit(kind ProxyEventKind, proxyID uint, proxy *models.Proxy) {
+	m.publish(ProxyEvent{
+		Kind:    kind,
+		ProxyID: proxyID,
+		Proxy:   proxy,
+	})
+}
+
+func (m *Manager) publish(event ProxyEvent) {
+	m.subscribersMu.Lock()
+	subscribers := m.subscribers
+	m.subscribersMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
@@ -0,0 +1,127 @@
+package proxymanager
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+)
+
+// expiryCheckInterval is how often provider key expiry is checked
+const expiryCheckInterval = time.Minute
+
+// expiryLevel is the closest warning threshold reached by a proxy
+type expiryLevel struct {
+	expiresAt time.Time
+	// level indexes thresholds, len(thresholds) means expired
+	level int
+}
+
+// ExpiryMonitor warns once per threshold before provider key of a proxy
+// expires, and once when it has expired
+type ExpiryMonitor struct {
+	manager *Manager
+	// thresholds are sorted from the longest to the shortest
+	thresholds []time.Duration
+	warned     map[uint]expiryLevel
+}
+
+func NewExpiryMonitor(mgr *Manager, warnHours []int) *ExpiryMonitor {
+	thresholds := make([]time.Duration, 0, len(warnHours))
+	for _, hours := range warnHours {
+		if hours > 0 {
+			thresholds = append(thresholds, time.Duration(hours)*time.Hour)
+		}
+	}
+	sort.Slice(thresholds, func(i, j int) bool {
+		return thresholds[i] > thresholds[j]
+	})
+
+	return &ExpiryMonitor{
+		manager:    mgr,
+		thresholds: thresholds,
+		warned:     make(map[uint]expiryLevel),
+	}
+}
+
+func (em *ExpiryMonitor) Start(ctx context.Context) {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	log.Printf("ExpiryMonitor started with warning thresholds: %v", em.thresholds)
+
+	em.checkAll()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("ExpiryMonitor stopped")
+			return
+		case <-ticker.C:
+			em.checkAll()
+		}
+	}
+}
+
+func (em *ExpiryMonitor) checkAll() {
+	proxies, err := em.manager.GetAllProxies()
+	if err != nil {
+		log.Printf("Failed to load proxies for expiry check: %v", err)
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[uint]bool, len(proxies))
+
+	for _, proxy := range proxies {
+		seen[proxy.ID] = true
+		if proxy.ExpiresAt == nil {
+			delete(em.warned, proxy.ID)
+			continue
+		}
+
+		expiresAt := *proxy.ExpiresAt
+		level := em.level(expiresAt.Sub(now))
+		if level < 0 {
+			delete(em.warned, proxy.ID)
+			continue
+		}
+
+		// Warn only when proxy reaches closer threshold, or its expiry changed
+		if prev, ok := em.warned[proxy.ID]; ok && prev.expiresAt.Equal(expiresAt) && prev.level >= level {
+			continue
+		}
+		em.warned[proxy.ID] = expiryLevel{
+			expiresAt: expiresAt,
+			level:     level,
+		}
+
+		if level == len(em.thresholds) {
+			log.Printf("WARNING: provider key of proxy %d (%s) expired at %s, auto-reset stopped", proxy.ID, proxy.ServiceType, expiresAt.Format(time.RFC3339))
+			em.manager.emit(ProxyExpired, proxy.ID, &proxy)
+		} else {
+			log.Printf("WARNING: provider key of proxy %d (%s) expires in %v (at %s)", proxy.ID, proxy.ServiceType, expiresAt.Sub(now).Round(time.Minute), expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	for id := range em.warned {
+		if !seen[id] {
+			delete(em.warned, id)
+		}
+	}
+}
+
+// level returns index of the shortest threshold remaining time is within,
+// len(thresholds) if already expired, or -1 if no threshold is reached yet
+func (em *ExpiryMonitor) level(remaining time.Duration) int {
+	if remaining <= 0 {
+		return len(em.thresholds)
+	}
+
+	level := -1
+	for i, threshold := range em.thresholds {
+		if remaining <= threshold {
+			level = i
+		}
+	}
+	return level
+}
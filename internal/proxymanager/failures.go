@@ -0,0 +1,67 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	derrors "go-forward-proxy/pkg/dumbproxy/dialer/errors"
+)
+
+// FailureKind classifies upstream dial failures observed on client traffic
+type FailureKind string
+
+const (
+	FailureConnRefused FailureKind = "connection_refused"
+	FailureProxyAuth   FailureKind = "upstream_407"
+	FailureTimeout     FailureKind = "timeout"
+)
+
+// classifyDialError maps upstream dial error to failure kind. Errors which
+// don't indicate broken upstream (client went away, target refused by
+// upstream, access denied, ...) are not counted.
+func classifyDialError(err error) (FailureKind, bool) {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return "", false
+	}
+
+	if dialErr := upstreamDialError(err); dialErr != nil && errors.Is(dialErr, syscall.ECONNREFUSED) {
+		return FailureConnRefused, true
+	}
+
+	var statusErr derrors.ErrBadProxyStatus
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusProxyAuthRequired {
+		return FailureProxyAuth, true
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+		return FailureTimeout, true
+	}
+
+	return "", false
+}
+
+// upstreamDialError returns error of dialing upstream itself. Errors
+// reported by upstream about the target (e.g. SOCKS5 "connection refused"
+// reply) are wrapped in operations other than "dial" and yield nil.
+func upstreamDialError(err error) *net.OpError {
+	var opErr *net.OpError
+	for errors.As(err, &opErr) {
+		if opErr.Op == "dial" {
+			return opErr
+		}
+		err = opErr.Err
+	}
+	return nil
+}
+
+// failureCounter counts upstream failures of a proxy within a time window
+type failureCounter struct {
+	count       int
+	windowStart time.Time
+	byKind      map[FailureKind]int
+}
@@ -0,0 +1,103 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+	"go-forward-proxy/internal/proxyservices"
+)
+
+var (
+	// ErrInvalidFreshnessWindow is returned for negative IP freshness window
+	ErrInvalidFreshnessWindow = errors.New("ip_freshness_window must not be negative")
+	// ErrFreshnessUnavailable is returned for IP freshness window when
+	// egress IP check is disabled
+	ErrFreshnessUnavailable = errors.New("ip_freshness_window needs IP check enabled (IP_CHECK_TIMEOUT > 0)")
+)
+
+// freshUpstream requests new upstream again while provider hands back exit
+// IP the proxy (or any proxy, if it asks for it) used within its freshness
+// window. It gives up and keeps the last upstream when attempts run out,
+// provider cooldown is longer than allowed wait, or provider call fails.
+func (m *Manager) freshUpstream(ctx context.Context, proxy *models.Proxy, service proxyservices.ProxyService, info *proxyservices.ProxyInfo) *proxyservices.ProxyInfo {
+	if proxy.IPFreshnessWindow <= 0 {
+		return info
+	}
+	if m.egress == nil {
+		// Window was set while IP check was enabled
+		log.Printf("WARNING: proxy %d has ip_freshness_window, but IP check is disabled, exit IP is not checked", proxy.ID)
+		return info
+	}
+
+	window := time.Duration(proxy.IPFreshnessWindow) * time.Second
+	maxWait := time.Duration(m.config.IPFreshnessMaxWait) * time.Second
+
+	for attempt := 1; ; attempt++ {
+		upstream, err := selectUpstream(info.Upstream, info.SOCKS5, proxy.UpstreamProtocol)
+		if err != nil {
+			// Caller rejects upstream without selected endpoint
+			return info
+		}
+		ip, err := m.egress.lookup(ctx, upstream.URL())
+		if err != nil {
+			// Can't tell whether IP is fresh, verification after rotation
+			// records the failure
+			return info
+		}
+
+		now := time.Now()
+		used, err := m.egress.usedSince(ip, proxy.ID, proxy.IPFreshnessGlobal, now.Add(-window))
+		if err != nil {
+			log.Printf("Failed to check freshness of exit IP %s for proxy %d: %v", ip, proxy.ID, err)
+			return info
+		}
+		if !used {
+			return info
+		}
+
+		// Keep recycled IP in history as evidence
+		entry := IPHistoryEntry{
+			ProxyID:    proxy.ID,
+			ProxyStr:   upstream.String(),
+			IP:         ip,
+			PreviousIP: proxy.EgressIP,
+			Error:      "exit IP was used within freshness window",
+			CheckedAt:  now,
+		}
+		if err := m.egress.record(&entry); err != nil {
+			log.Printf("Failed to record recycled exit IP of proxy %d: %v", proxy.ID, err)
+		}
+
+		if attempt >= m.config.IPFreshnessAttempts {
+			log.Printf("WARNING: proxy %d got recycled exit IP %s, giving up after %d attempt(s)", proxy.ID, ip, attempt)
+			return info
+		}
+
+		// Provider may not allow next rotation right away
+		var wait time.Duration
+		if current, err := service.GetCurrentProxy(ctx, proxy.APIKey); err == nil {
+			wait = time.Duration(current.NextResetAfter) * time.Second
+		}
+		if wait > maxWait {
+			log.Printf("WARNING: proxy %d got recycled exit IP %s, provider cooldown %v is longer than %v, giving up", proxy.ID, ip, wait, maxWait)
+			return info
+		}
+
+		log.Printf("Proxy %d got recycled exit IP %s, requesting new proxy again in %v (attempt %d)", proxy.ID, ip, wait, attempt+1)
+		select {
+		case <-ctx.Done():
+			return info
+		case <-time.After(wait):
+		}
+
+		next, err := service.GetNewProxy(ctx, proxy.APIKey, proxy.ProviderOptions)
+		if err != nil {
+			log.Printf("WARNING: proxy %d keeps recycled exit IP %s, new proxy request failed: %v", proxy.ID, ip, err)
+			return info
+		}
+		info = next
+	}
+}
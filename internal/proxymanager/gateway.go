@@ -0,0 +1,366 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-forward-proxy/internal/config"
+	"go-forward-proxy/pkg/dumbproxy/auth"
+	ddto "go-forward-proxy/pkg/dumbproxy/dialer/dto"
+	"go-forward-proxy/pkg/dumbproxy/forward"
+	"go-forward-proxy/pkg/dumbproxy/handler"
+	clog "go-forward-proxy/pkg/dumbproxy/log"
+
+	"github.com/things-go/go-socks5"
+)
+
+// Gateway balancing strategies
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyRandom     = "random"
+)
+
+// sessionSeparator separates login from sticky session id in gateway
+// usernames, e.g. "user-session-abc123"
+const sessionSeparator = "-session-"
+
+var ErrNoHealthyUpstream = errors.New("no healthy upstream available")
+
+// splitSessionUsername splits gateway username into login and session id
+func splitSessionUsername(username string) (string, string) {
+	idx := strings.LastIndex(username, sessionSeparator)
+	if idx < 0 {
+		return username, ""
+	}
+	return username[:idx], username[idx+len(sessionSeparator):]
+}
+
+type gatewaySession struct {
+	proxyID   uint
+	expiresAt time.Time
+}
+
+// Gateway is a single listener which spreads client connections across
+// upstreams of all healthy managed instances
+type Gateway struct {
+	manager    *Manager
+	port       int
+	strategy   string
+	sessionTTL time.Duration
+	logger     *clog.CondLogger
+	auth       *gatewayAuth
+	conns      *connRegistry
+	listener   net.Listener
+	server     *http.Server
+	cancel     context.CancelFunc
+	rrCounter  atomic.Uint64
+
+	sessionsMu sync.Mutex
+	sessions   map[string]gatewaySession
+}
+
+func NewGateway(mgr *Manager, cfg *config.Config) (*Gateway, error) {
+	switch cfg.GatewayStrategy {
+	case StrategyRoundRobin, StrategyLeastConn, StrategyRandom:
+	default:
+		return nil, fmt.Errorf("unknown gateway strategy: %s", cfg.GatewayStrategy)
+	}
+
+	logger := clog.NewCondLogger(
+		log.New(os.Stderr, "[Gateway] ", log.LstdFlags),
+		clog.INFO,
+	)
+
+	baseAuth, err := newStaticAuth(cfg.GatewayUsername, cfg.GatewayPassword, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth: %w", err)
+	}
+
+	return &Gateway{
+		manager:    mgr,
+		port:       cfg.GatewayPort,
+		strategy:   cfg.GatewayStrategy,
+		sessionTTL: time.Duration(cfg.GatewaySessionTTL) * time.Second,
+		logger:     logger,
+		auth:       &gatewayAuth{base: baseAuth},
+		conns:      newConnRegistry(),
+		sessions:   make(map[string]gatewaySession),
+	}, nil
+}
+
+// Start serves HTTP and SOCKS5 on gateway port until Stop is called
+func (g *Gateway) Start(ctx context.Context) error {
+	addr := fmt.Sprintf(":%d", g.port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	g.listener = listener
+
+	// Traffic is counted towards the instance picked for the connection,
+	// under gateway login without sticky session suffix
+	forwardFunc := forward.PairConnections
+	if usage := g.manager.usage; usage != nil {
+		counted := usage.wrap(pickedProxyID, forward.PairConnections)
+		forwardFunc = func(ctx context.Context, username string, incoming, outgoing io.ReadWriteCloser, network, address string) error {
+			login, _ := splitSessionUsername(username)
+			return counted(ctx, login, incoming, outgoing, network, address)
+		}
+	}
+
+	// Track gateway connections so they can be drained on shutdown
+	forwardFunc = g.conns.wrap(forwardFunc)
+
+	g.server = &http.Server{
+		Handler: withHTTPGatewayPick(handler.NewProxyHandler(&handler.Config{
+			Dialer:  g,
+			Auth:    g.auth,
+			Logger:  g.logger,
+			Forward: forwardFunc,
+		})),
+	}
+
+	socksServer := socks5.NewServer(
+		socks5.WithLogger(socks5.NewLogger(log.New(os.Stderr, "[Gateway] SOCKS: ", log.LstdFlags))),
+		socks5.WithRule(&socks5.PermitCommand{
+			EnableConnect: true,
+		}),
+		socks5.WithConnectHandle(withSOCKSGatewayPick(handler.SOCKSHandler(g, g.logger, forwardFunc))),
+		socks5.WithResolver(handler.DummySocksResolver{}),
+		socks5.WithCredential(g.auth),
+	)
+
+	mux := newProtoMux(listener)
+	go mux.Serve()
+	go func() {
+		if err := g.server.Serve(mux.http); err != nil && err != http.ErrServerClosed {
+			g.logger.Error("Server error: %v", err)
+		}
+	}()
+	go func() {
+		if err := socksServer.Serve(mux.socks); err != nil && !errors.Is(err, net.ErrClosed) {
+			g.logger.Error("SOCKS5 server error: %v", err)
+		}
+	}()
+	sessionsCtx, cancel := context.WithCancel(ctx)
+	g.cancel = cancel
+	go g.expireSessions(sessionsCtx)
+
+	g.logger.Info("Gateway listening on port %d (strategy: %s, session TTL: %v)", g.port, g.strategy, g.sessionTTL)
+	return nil
+}
+
+// Shutdown stops accepting new connections and waits for active ones to
+// finish until ctx is done, then force-closes the rest. Returns number of
+// connections which were cut.
+func (g *Gateway) Shutdown(ctx context.Context) int {
+	if g.listener == nil {
+		return 0
+	}
+
+	g.cancel()
+	g.listener.Close()
+	shutdownErr := g.server.Shutdown(ctx)
+	cut := g.conns.Drain(ctx)
+	if shutdownErr != nil {
+		g.server.Close()
+	}
+	g.auth.Close()
+
+	if cut > 0 {
+		g.logger.Warning("Gateway stopped, %d connection(s) cut after drain deadline", cut)
+	} else {
+		g.logger.Info("Gateway stopped")
+	}
+	return cut
+}
+
+func (g *Gateway) Dial(network, address string) (net.Conn, error) {
+	return g.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials address through upstream picked for the request
+func (g *Gateway) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	_, username := ddto.FilterParamsFromContext(ctx)
+	_, session := splitSessionUsername(username)
+
+	instance, err := g.pick(session)
+	if err != nil {
+		return nil, err
+	}
+	if picked, ok := ctx.Value(gatewayPickKey{}).(*atomic.Uint64); ok {
+		picked.Store(uint64(instance.ProxyID))
+	}
+
+	// Dial through instance's own dialer so the connection is tracked,
+	// drained on rotation and counted towards its failure budget
+	return instance.dialer.DialContext(ctx, network, address)
+}
+
+type gatewayPickKey struct{}
+
+// withGatewayPick adds slot for ID of the instance picked by DialContext
+func withGatewayPick(ctx context.Context) context.Context {
+	return context.WithValue(ctx, gatewayPickKey{}, new(atomic.Uint64))
+}
+
+func withHTTPGatewayPick(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		next.ServeHTTP(wr, req.WithContext(withGatewayPick(req.Context())))
+	})
+}
+
+func withSOCKSGatewayPick(next func(ctx context.Context, writer io.Writer, request *socks5.Request) error) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		return next(withGatewayPick(ctx), writer, request)
+	}
+}
+
+// pickedProxyID returns ID of the instance picked for the connection, or 0
+// if nothing has been dialed yet
+func pickedProxyID(ctx context.Context) uint {
+	if picked, ok := ctx.Value(gatewayPickKey{}).(*atomic.Uint64); ok {
+		return uint(picked.Load())
+	}
+	return 0
+}
+
+// pick selects upstream instance for a connection. Sticky sessions stay on
+// the same instance until TTL expires or the instance becomes unhealthy.
+func (g *Gateway) pick(session string) (*ProxyInstance, error) {
+	candidates := g.healthyInstances()
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	if session == "" {
+		return g.choose(candidates), nil
+	}
+
+	now := time.Now()
+
+	g.sessionsMu.Lock()
+	defer g.sessionsMu.Unlock()
+
+	if s, ok := g.sessions[session]; ok && now.Before(s.expiresAt) {
+		for _, instance := range candidates {
+			if instance.ProxyID == s.proxyID {
+				return instance, nil
+			}
+		}
+	}
+
+	instance := g.choose(candidates)
+	g.sessions[session] = gatewaySession{
+		proxyID:   instance.ProxyID,
+		expiresAt: now.Add(g.sessionTTL),
+	}
+	return instance, nil
+}
+
+func (g *Gateway) choose(candidates []*ProxyInstance) *ProxyInstance {
+	switch g.strategy {
+	case StrategyLeastConn:
+		best := candidates[0]
+		bestConns := best.dialer.ActiveConns()
+		for _, instance := range candidates[1:] {
+			if conns := instance.dialer.ActiveConns(); conns < bestConns {
+				best, bestConns = instance, conns
+			}
+		}
+		return best
+	case StrategyRandom:
+		return candidates[rand.IntN(len(candidates))]
+	default:
+		n := g.rrCounter.Add(1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+// healthyInstances returns running healthy instances ordered by proxy ID
+func (g *Gateway) healthyInstances() []*ProxyInstance {
+	var healthy []*ProxyInstance
+	for _, instance := range g.manager.runningInstances() {
+		if instance.Health().Healthy {
+			healthy = append(healthy, instance)
+		}
+	}
+
+	sort.Slice(healthy, func(i, j int) bool {
+		return healthy[i].ProxyID < healthy[j].ProxyID
+	})
+	return healthy
+}
+
+func (g *Gateway) expireSessions(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.sessionsMu.Lock()
+			for session, s := range g.sessions {
+				if now.After(s.expiresAt) {
+					delete(g.sessions, session)
+				}
+			}
+			g.sessionsMu.Unlock()
+		}
+	}
+}
+
+// gatewayAuth validates gateway logins ignoring sticky session suffix. The
+// full username, including session, is passed on to the dialer.
+type gatewayAuth struct {
+	base auth.Auth
+}
+
+func (ga *gatewayAuth) Validate(ctx context.Context, wr http.ResponseWriter, req *http.Request) (string, bool) {
+	username, password, ok := proxyBasicAuth(req)
+	if !ok {
+		return ga.base.Validate(ctx, wr, req)
+	}
+
+	login, _ := splitSessionUsername(username)
+	if login == username {
+		return ga.base.Validate(ctx, wr, req)
+	}
+
+	// Validate login without session suffix against base auth
+	stripped := req.Clone(ctx)
+	stripped.Header.Set("Proxy-Authorization", "Basic "+basicAuthToken(login, password))
+	if _, ok := ga.base.Validate(ctx, wr, stripped); !ok {
+		return "", false
+	}
+	return username, true
+}
+
+// Valid implements socks5.CredentialStore
+func (ga *gatewayAuth) Valid(user, password, userAddr string) bool {
+	cs, ok := ga.base.(socks5.CredentialStore)
+	if !ok {
+		return false
+	}
+	login, _ := splitSessionUsername(user)
+	return cs.Valid(login, password, userAddr)
+}
+
+func (ga *gatewayAuth) Close() error {
+	return ga.base.Close()
+}
@@ -0,0 +1,117 @@
+package proxymanager
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// HealthStatus holds result of upstream health checks for a proxy instance
+type HealthStatus struct {
+	Healthy             bool          `json:"healthy"`
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	LastLatency         time.Duration `json:"last_latency"`
+	LastError           string        `json:"last_error,omitempty"`
+	LastCheckAt         time.Time     `json:"last_check_at"`
+}
+
+type HealthChecker struct {
+	manager          *Manager
+	target           string
+	interval         time.Duration
+	timeout          time.Duration
+	failureThreshold int
+	onUnhealthy      func(proxyID uint)
+}
+
+func NewHealthChecker(mgr *Manager, target string, interval, timeout, failureThreshold int, onUnhealthy func(proxyID uint)) *HealthChecker {
+	if failureThreshold < 1 {
+		failureThreshold = 1
+	}
+	return &HealthChecker{
+		manager:          mgr,
+		target:           target,
+		interval:         time.Duration(interval) * time.Second,
+		timeout:          time.Duration(timeout) * time.Second,
+		failureThreshold: failureThreshold,
+		onUnhealthy:      onUnhealthy,
+	}
+}
+
+func (hc *HealthChecker) Start(ctx context.Context) {
+	if hc.interval <= 0 {
+		log.Println("HealthChecker disabled")
+		return
+	}
+
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	log.Printf("HealthChecker started with interval: %v, target: %s", hc.interval, hc.target)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("HealthChecker stopped")
+			return
+		case <-ticker.C:
+			hc.checkAll(ctx)
+		}
+	}
+}
+
+func (hc *HealthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, instance := range hc.manager.runningInstances() {
+		wg.Add(1)
+		go func(instance *ProxyInstance) {
+			defer wg.Done()
+			hc.check(ctx, instance)
+		}(instance)
+	}
+	wg.Wait()
+}
+
+func (hc *HealthChecker) check(ctx context.Context, instance *ProxyInstance) {
+	checkCtx, cancel := context.WithTimeout(ctx, hc.timeout)
+	defer cancel()
+
+	// Dial through current upstream directly so health probes are not
+	// counted as client connections
+	start := time.Now()
+	conn, err := instance.dialer.Upstream().DialContext(checkCtx, "tcp", hc.target)
+	latency := time.Since(start)
+	if err == nil {
+		conn.Close()
+	}
+
+	status := instance.recordHealthCheck(latency, err, hc.failureThreshold)
+	if err != nil {
+		log.Printf("Health check failed for proxy %d (%d consecutive): %v", instance.ProxyID, status.ConsecutiveFailures, err)
+	}
+
+	// Notify once, when failures reach threshold
+	if err != nil && status.ConsecutiveFailures == hc.failureThreshold {
+		hc.notifyDegraded(instance.ProxyID, err)
+	}
+
+	if !status.Healthy && hc.onUnhealthy != nil {
+		hc.onUnhealthy(instance.ProxyID)
+	}
+}
+
+func (hc *HealthChecker) notifyDegraded(proxyID uint, checkErr error) {
+	proxy, err := hc.manager.GetProxyByID(proxyID)
+	if err != nil {
+		log.Printf("Failed to load proxy %d for health event: %v", proxyID, err)
+		return
+	}
+
+	hc.manager.publish(ProxyEvent{
+		Kind:    ProxyHealthDegraded,
+		ProxyID: proxyID,
+		Proxy:   proxy,
+		Error:   checkErr.Error(),
+	})
+}
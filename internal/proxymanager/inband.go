@@ -0,0 +1,191 @@
+package proxymanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// RotateHost is magic host clients request through their proxy port, e.g.
+// "CONNECT rotate.proxy.local:0", "GET http://rotate.proxy.local/" or
+// SOCKS5 CONNECT to rotate.proxy.local, to rotate upstream of that proxy
+// without access to management API
+const RotateHost = "rotate.proxy.local"
+
+// ProxyIPHeaderName carries new upstream IP in rotation response, for
+// clients which can't read body of CONNECT response
+const ProxyIPHeaderName = "X-Proxy-IP"
+
+// rotateResponse is body of in-band rotation response
+type rotateResponse struct {
+	ProxyID            uint       `json:"proxy_id"`
+	IP                 string     `json:"ip,omitempty"`
+	RotatedAt          *time.Time `json:"rotated_at,omitempty"`
+	NextResetAllowedAt *time.Time `json:"next_reset_allowed_at,omitempty"`
+	RetryAfter         int        `json:"retry_after,omitempty"` // Seconds
+	Error              string     `json:"error,omitempty"`
+}
+
+// withRotateControl serves in-band rotation requests to RotateHost and
+// passes everything else to next. Rotation requires the same credentials
+// as proxying.
+func (pi *ProxyInstance) withRotateControl(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(wr http.ResponseWriter, req *http.Request) {
+		if !isRotateRequest(req) {
+			next.ServeHTTP(wr, req)
+			return
+		}
+
+		username, ok := pi.auth.Validate(req.Context(), wr, req)
+		pi.logger.Info("Rotate request: %v %q %v %v", req.RemoteAddr, username, req.Method, req.Host)
+		if !ok {
+			return
+		}
+
+		if pi.onRotate == nil {
+			writeRotateResponse(wr, http.StatusNotImplemented, rotateResponse{
+				ProxyID: pi.ProxyID,
+				Error:   "rotation is not available",
+			})
+			return
+		}
+
+		proxy, err := pi.onRotate(req.Context(), pi.ProxyID)
+		if err != nil {
+			pi.writeRotateError(wr, err)
+			return
+		}
+
+		ip := rotatedIP(proxy)
+		pi.logger.Info("Upstream rotated on client request, new IP: %s", ip)
+		wr.Header().Set(ProxyIPHeaderName, ip)
+		writeRotateResponse(wr, http.StatusOK, rotateResponse{
+			ProxyID:            proxy.ID,
+			IP:                 ip,
+			RotatedAt:          &proxy.LastResetAt,
+			NextResetAllowedAt: proxy.NextResetAllowedAt,
+		})
+	})
+}
+
+func (pi *ProxyInstance) writeRotateError(wr http.ResponseWriter, err error) {
+	var cooldown *CooldownError
+	if errors.As(err, &cooldown) {
+		retryAfter := max(int(math.Ceil(cooldown.RetryAfter(time.Now()).Seconds())), 1)
+		wr.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeRotateResponse(wr, http.StatusTooManyRequests, rotateResponse{
+			ProxyID:            pi.ProxyID,
+			NextResetAllowedAt: &cooldown.AllowedAt,
+			RetryAfter:         retryAfter,
+			Error:              err.Error(),
+		})
+		return
+	}
+	var expired *ExpiredError
+	if errors.As(err, &expired) || errors.Is(err, ErrProxyNotActive) {
+		writeRotateResponse(wr, http.StatusConflict, rotateResponse{
+			ProxyID: pi.ProxyID,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	pi.logger.Error("In-band rotation failed: %v", err)
+	writeRotateResponse(wr, http.StatusBadGateway, rotateResponse{
+		ProxyID: pi.ProxyID,
+		Error:   err.Error(),
+	})
+}
+
+// withSOCKSRotateControl serves in-band rotation over SOCKS5. CONNECT to
+// RotateHost rotates upstream and is answered with new IP as bound address,
+// then connection is closed. SOCKS5 server has checked credentials already.
+func (pi *ProxyInstance) withSOCKSRotateControl(next func(ctx context.Context, writer io.Writer, request *socks5.Request) error) func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+		if !strings.EqualFold(request.DestAddr.FQDN, RotateHost) {
+			return next(ctx, writer, request)
+		}
+
+		username := ""
+		if request.AuthContext != nil {
+			username = request.AuthContext.Payload["username"]
+		}
+		pi.logger.Info("Rotate request: %v %q SOCKS5 %v", request.RemoteAddr, username, request.DestAddr)
+
+		if pi.onRotate == nil {
+			socks5.SendReply(writer, statute.RepCommandNotSupported, nil)
+			return errors.New("rotation is not available")
+		}
+
+		proxy, err := pi.onRotate(ctx, pi.ProxyID)
+		if err != nil {
+			// SOCKS5 reply has no room for details, refused rotation is
+			// told apart from failed one by reply code only
+			var cooldown *CooldownError
+			var expired *ExpiredError
+			if errors.As(err, &cooldown) || errors.As(err, &expired) || errors.Is(err, ErrProxyNotActive) {
+				socks5.SendReply(writer, statute.RepRuleFailure, nil)
+				return nil
+			}
+			pi.logger.Error("In-band rotation failed: %v", err)
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return err
+		}
+
+		ip := rotatedIP(proxy)
+		pi.logger.Info("Upstream rotated on client request, new IP: %s", ip)
+
+		// Upstream given by hostname can't be sent as bound address
+		bindIP := net.ParseIP(ip)
+		if bindIP == nil {
+			bindIP = net.IPv4zero
+		}
+		return socks5.SendReply(writer, statute.RepSuccess, &net.TCPAddr{IP: bindIP})
+	}
+}
+
+// rotatedIP returns egress IP of rotated proxy, or host of its upstream if
+// IP check failed or is disabled
+func rotatedIP(proxy *models.Proxy) string {
+	// Verified egress IP is known only when IP check succeeded
+	if proxy.EgressError == "" && proxy.EgressIP != "" {
+		return proxy.EgressIP
+	}
+	if upstream, err := proxyUpstream(proxy); err == nil {
+		return upstream.Host
+	}
+	return ""
+}
+
+func writeRotateResponse(wr http.ResponseWriter, status int, body rotateResponse) {
+	data, _ := json.Marshal(body)
+	wr.Header().Set("Content-Type", "application/json")
+	wr.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	wr.Header().Set("Connection", "close")
+	wr.WriteHeader(status)
+	wr.Write(data)
+}
+
+// isRotateRequest reports whether request targets RotateHost
+func isRotateRequest(req *http.Request) bool {
+	host := req.Host
+	if req.URL != nil && req.URL.Host != "" {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.EqualFold(host, RotateHost)
+}
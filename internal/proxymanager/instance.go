@@ -2,83 +2,140 @@ package proxymanager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"go-forward-proxy/internal/config"
-	"go-forward-proxy/pkg/dumbproxy/auth"
+	"go-forward-proxy/internal/database/models"
 	"go-forward-proxy/pkg/dumbproxy/dialer"
 	"go-forward-proxy/pkg/dumbproxy/forward"
 	"go-forward-proxy/pkg/dumbproxy/handler"
 	clog "go-forward-proxy/pkg/dumbproxy/log"
+
+	"github.com/things-go/go-socks5"
+)
+
+// Listener modes of a proxy instance
+const (
+	ModeHTTP   = "http"
+	ModeSOCKS5 = "socks5"
+	ModeBoth   = "both" // HTTP and SOCKS5 on the same port
 )
 
+var ErrInvalidMode = errors.New("mode must be 'http', 'socks5' or 'both'")
+
+// ValidMode reports whether mode is a known listener mode
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeHTTP, ModeSOCKS5, ModeBoth:
+		return true
+	}
+	return false
+}
+
 type ProxyInstance struct {
 	ProxyID     uint
 	Port        int
 	ServiceType string
+	Mode        string
 	Listener    net.Listener
 	Handler     *handler.ProxyHandler
 	Server      *http.Server
 	Cancel      context.CancelFunc
 	mu          sync.RWMutex
 	logger      *clog.CondLogger
-	auth        auth.Auth
-	dialer      dialer.Dialer
+	auth        *swapAuth
+	dialer      *swapDialer
+	forward     handler.ForwardFunc
+	conns       *connRegistry
+	healthMu    sync.Mutex
+	health      HealthStatus
+	// onUpstreamFailure receives classified upstream dial failures
+	onUpstreamFailure func(proxyID uint, kind FailureKind, err error)
+	// onRotate rotates upstream on in-band request of a client
+	onRotate func(ctx context.Context, proxyID uint) (*models.Proxy, error)
+	// usage records traffic of forwarded connections, optional
+	usage *UsageRecorder
+	// shutdownTimeout is how long Stop lets active connections finish
+	shutdownTimeout time.Duration
+	stopped         bool
 }
 
-func NewProxyInstance(proxyID uint, proxyStr, serviceType string, cfg *config.Config) (*ProxyInstance, error) {
-	port := int(proxyID) + 10000
+func NewProxyInstance(proxy *models.Proxy, cfg *config.Config) (*ProxyInstance, error) {
+	mode := proxy.Mode
+	if mode == "" {
+		mode = ModeHTTP
+	}
+	if !ValidMode(mode) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMode, mode)
+	}
 
 	// Create logger
 	logger := clog.NewCondLogger(
-		log.New(os.Stderr, fmt.Sprintf("[Proxy-%d] ", proxyID), log.LstdFlags),
+		log.New(os.Stderr, fmt.Sprintf("[Proxy-%d] ", proxy.ID), log.LstdFlags),
 		clog.INFO,
 	)
 
-	// Create auth provider
-	authURL := fmt.Sprintf("static://?username=%s&password=%s", cfg.Username, cfg.Password)
-	fmt.Println("authURL", authURL)
-	authProvider, err := auth.NewAuth(authURL, logger)
+	// Create auth provider from proxy's own credentials
+	if proxy.Username == "" || proxy.Password == "" {
+		return nil, fmt.Errorf("proxy %d has no client credentials", proxy.ID)
+	}
+	staticAuth, err := newStaticAuth(proxy.Username, proxy.Password, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create auth: %w", err)
 	}
+	authProvider := newSwapAuth(staticAuth)
 
 	// Parse proxy string and create upstream dialer
-	upstreamURL, err := parseProxyStr(proxyStr, serviceType)
+	upstream, err := proxyUpstream(proxy)
 	if err != nil {
 		authProvider.Close()
-		return nil, fmt.Errorf("failed to parse proxy string: %w", err)
+		return nil, err
 	}
 
-	upstreamDialer, err := dialer.ProxyDialerFromURL(upstreamURL, &net.Dialer{})
+	upstreamDialer, err := dialer.ProxyDialerFromURL(upstream.URL(), &net.Dialer{})
 	if err != nil {
 		authProvider.Close()
 		return nil, fmt.Errorf("failed to create upstream dialer: %w", err)
 	}
 
-	// Create proxy handler
-	proxyHandler := handler.NewProxyHandler(&handler.Config{
-		Dialer:  upstreamDialer,
-		Auth:    authProvider,
-		Logger:  logger,
-		Forward: forward.PairConnections,
-	})
+	// Wrap upstream dialer so it can be swapped without rebuilding handler
+	drainTimeout := time.Duration(cfg.UpstreamDrainTimeout) * time.Second
+	swappable := newSwapDialer(upstreamDialer, drainTimeout, logger)
 
 	instance := &ProxyInstance{
-		ProxyID:     proxyID,
-		Port:        port,
-		ServiceType: serviceType,
-		Handler:     proxyHandler,
+		ProxyID:     proxy.ID,
+		Port:        proxy.Port,
+		ServiceType: proxy.ServiceType,
+		Mode:        mode,
 		logger:      logger,
 		auth:        authProvider,
-		dialer:      upstreamDialer,
+		dialer:      swappable,
+		conns:       newConnRegistry(),
+		health:      HealthStatus{Healthy: true},
+
+		shutdownTimeout: time.Duration(cfg.ShutdownTimeout) * time.Second,
 	}
+	swappable.onDialError = instance.reportDialFailure
+
+	// Register forwarded connections so they can be listed and killed
+	instance.forward = instance.conns.wrap(instance.forwardCounted)
+
+	// Create proxy handler
+	instance.Handler = handler.NewProxyHandler(&handler.Config{
+		Dialer:  swappable,
+		Auth:    authProvider,
+		Logger:  logger,
+		Forward: instance.forward,
+	})
 
 	return instance, nil
 }
@@ -91,6 +148,9 @@ func (pi *ProxyInstance) Start(ctx context.Context) error {
 	addr := fmt.Sprintf(":%d", pi.Port)
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
+		if errors.Is(err, syscall.EADDRINUSE) {
+			return fmt.Errorf("%w: %d", ErrPortTaken, pi.Port)
+		}
 		return fmt.Errorf("failed to listen on %s: %w", addr, err)
 	}
 
@@ -98,20 +158,26 @@ func (pi *ProxyInstance) Start(ctx context.Context) error {
 
 	// Create HTTP server
 	pi.Server = &http.Server{
-		Handler: pi.Handler,
+		Handler: withHTTPClientInfo(pi.withRotateControl(pi.Handler)),
 	}
 
 	// Create cancellable context
 	childCtx, cancel := context.WithCancel(ctx)
 	pi.Cancel = cancel
 
-	// Start server in goroutine
-	go func() {
-		pi.logger.Info("Starting proxy instance on port %d", pi.Port)
-		if err := pi.Server.Serve(pi.Listener); err != nil && err != http.ErrServerClosed {
-			pi.logger.Error("Server error: %v", err)
-		}
-	}()
+	// Start servers in goroutines
+	pi.logger.Info("Starting proxy instance on port %d (mode: %s)", pi.Port, pi.Mode)
+	switch pi.Mode {
+	case ModeSOCKS5:
+		go pi.serveSOCKS(listener)
+	case ModeBoth:
+		mux := newProtoMux(listener)
+		go mux.Serve()
+		go pi.serveHTTP(mux.http)
+		go pi.serveSOCKS(mux.socks)
+	default:
+		go pi.serveHTTP(listener)
+	}
 
 	// Wait for context cancellation
 	go func() {
@@ -122,94 +188,211 @@ func (pi *ProxyInstance) Start(ctx context.Context) error {
 	return nil
 }
 
-func (pi *ProxyInstance) UpdateUpstream(proxyStr string) error {
+func (pi *ProxyInstance) serveHTTP(listener net.Listener) {
+	if err := pi.Server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		pi.logger.Error("Server error: %v", err)
+	}
+}
+
+// serveSOCKS serves SOCKS5 with the same upstream dialer and credentials
+// as the HTTP proxy
+func (pi *ProxyInstance) serveSOCKS(listener net.Listener) {
+	server := socks5.NewServer(
+		socks5.WithLogger(socks5.NewLogger(log.New(os.Stderr, fmt.Sprintf("[Proxy-%d] SOCKS: ", pi.ProxyID), log.LstdFlags))),
+		socks5.WithRule(&socks5.PermitCommand{
+			EnableConnect: true,
+		}),
+		socks5.WithConnectHandle(withSOCKSClientInfo(pi.withSOCKSRotateControl(handler.SOCKSHandler(pi.dialer, pi.logger, pi.forward)))),
+		socks5.WithResolver(handler.DummySocksResolver{}),
+		socks5.WithCredential(pi.auth),
+	)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+		pi.logger.Error("SOCKS5 server error: %v", err)
+	}
+}
+
+// UpdateUpstream swaps upstream dialer to given upstream URL
+func (pi *ProxyInstance) UpdateUpstream(upstreamURL string) error {
 	pi.mu.Lock()
 	defer pi.mu.Unlock()
 
 	pi.logger.Info("Updating upstream proxy")
 
-	// Parse new proxy string
-	upstreamURL, err := parseProxyStr(proxyStr, pi.ServiceType)
-	if err != nil {
-		return fmt.Errorf("failed to parse proxy string: %w", err)
-	}
-
 	// Create new upstream dialer
 	newDialer, err := dialer.ProxyDialerFromURL(upstreamURL, &net.Dialer{})
 	if err != nil {
 		return fmt.Errorf("failed to create new upstream dialer: %w", err)
 	}
 
-	// Update handler's dialer
-	// Note: We need to create a new handler with the new dialer
-	newHandler := handler.NewProxyHandler(&handler.Config{
-		Dialer:  newDialer,
-		Auth:    pi.auth,
-		Logger:  pi.logger,
-		Forward: forward.PairConnections,
-	})
-
-	// Update server handler
-	if pi.Server != nil {
-		pi.Server.Handler = newHandler
+	// Swap dialer in place. Tunnels opened through previous upstream keep
+	// running until they finish or drain timeout passes.
+	pi.dialer.Swap(newDialer)
+	if draining := pi.dialer.DrainingConns(); draining > 0 {
+		pi.logger.Info("%d connection(s) draining on previous upstream", draining)
 	}
 
-	pi.Handler = newHandler
-	pi.dialer = newDialer
+	// New upstream starts with a clean health record
+	pi.healthMu.Lock()
+	pi.health = HealthStatus{Healthy: true}
+	pi.healthMu.Unlock()
 
 	pi.logger.Info("Upstream proxy updated successfully")
 	return nil
 }
 
-func (pi *ProxyInstance) Stop() error {
-	pi.mu.Lock()
-	defer pi.mu.Unlock()
+// forwardCounted pairs client and upstream connections, counting their
+// traffic when usage recorder is set
+func (pi *ProxyInstance) forwardCounted(ctx context.Context, username string, incoming, outgoing io.ReadWriteCloser, network, address string) error {
+	if pi.usage == nil {
+		return forward.PairConnections(ctx, username, incoming, outgoing, network, address)
+	}
 
-	pi.logger.Info("Stopping proxy instance")
+	proxyID := func(context.Context) uint { return pi.ProxyID }
+	return pi.usage.wrap(proxyID, forward.PairConnections)(ctx, username, incoming, outgoing, network, address)
+}
 
-	// Close auth provider
-	if pi.auth != nil {
-		pi.auth.Close()
+// reportDialFailure forwards upstream dial failures caused by broken upstream
+func (pi *ProxyInstance) reportDialFailure(err error) {
+	kind, ok := classifyDialError(err)
+	if !ok {
+		return
 	}
 
-	// Shutdown HTTP server
-	if pi.Server != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5)
-		defer cancel()
-		if err := pi.Server.Shutdown(ctx); err != nil {
-			pi.logger.Error("Failed to shutdown server: %v", err)
+	pi.logger.Warning("Upstream dial failure (%s): %v", kind, err)
+	if pi.onUpstreamFailure != nil {
+		pi.onUpstreamFailure(pi.ProxyID, kind, err)
+	}
+}
+
+// Health returns last known upstream health status
+func (pi *ProxyInstance) Health() HealthStatus {
+	pi.healthMu.Lock()
+	defer pi.healthMu.Unlock()
+	return pi.health
+}
+
+func (pi *ProxyInstance) recordHealthCheck(latency time.Duration, err error, failureThreshold int) HealthStatus {
+	pi.healthMu.Lock()
+	defer pi.healthMu.Unlock()
+
+	pi.health.LastCheckAt = time.Now()
+	pi.health.LastLatency = latency
+	if err != nil {
+		pi.health.ConsecutiveFailures++
+		pi.health.LastError = err.Error()
+		if pi.health.ConsecutiveFailures >= failureThreshold {
+			if pi.health.Healthy {
+				pi.logger.Warning("Upstream marked unhealthy after %d consecutive failures", pi.health.ConsecutiveFailures)
+			}
+			pi.health.Healthy = false
+		}
+	} else {
+		if !pi.health.Healthy {
+			pi.logger.Info("Upstream is healthy again")
 		}
+		pi.health.ConsecutiveFailures = 0
+		pi.health.LastError = ""
+		pi.health.Healthy = true
 	}
 
-	// Close listener
-	if pi.Listener != nil {
-		pi.Listener.Close()
+	return pi.health
+}
+
+// UpdateCredentials replaces client credentials without restarting listener.
+// New requests must use new credentials, established tunnels keep running.
+func (pi *ProxyInstance) UpdateCredentials(username, password string) error {
+	newAuth, err := newStaticAuth(username, password, pi.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create auth: %w", err)
 	}
 
-	pi.logger.Info("Proxy instance stopped")
+	pi.auth.Swap(newAuth)
+	pi.logger.Info("Client credentials rotated")
 	return nil
 }
 
-// parseProxyStr converts proxy_str to upstream URL format for dumbproxy
-func parseProxyStr(proxyStr, serviceType string) (string, error) {
-	parts := strings.Split(proxyStr, ":")
+// Connections returns active connections served by the instance
+func (pi *ProxyInstance) Connections() []ConnectionInfo {
+	return pi.conns.List()
+}
 
-	switch serviceType {
-	case "tmproxy":
-		// Format: "ip:port:username:password"
-		if len(parts) != 4 {
-			return "", fmt.Errorf("invalid tmproxy format, expected ip:port:username:password")
-		}
-		return fmt.Sprintf("http://%s:%s@%s:%s", parts[2], parts[3], parts[0], parts[1]), nil
+// KillConnection terminates active connection by its ID
+func (pi *ProxyInstance) KillConnection(id uint64) error {
+	if err := pi.conns.Kill(id); err != nil {
+		return err
+	}
 
-	case "kiotproxy":
-		// Format: "ip:port"
-		if len(parts) != 2 {
-			return "", fmt.Errorf("invalid kiotproxy format, expected ip:port")
-		}
-		return fmt.Sprintf("http://%s:%s", parts[0], parts[1]), nil
+	pi.logger.Info("Connection %d terminated by request", id)
+	return nil
+}
 
-	default:
-		return "", fmt.Errorf("unknown service type: %s", serviceType)
+// DrainingConns returns number of connections still using previous upstream
+func (pi *ProxyInstance) DrainingConns() int {
+	return pi.dialer.DrainingConns()
+}
+
+// Stop shuts instance down, giving active connections configured shutdown
+// timeout to finish
+func (pi *ProxyInstance) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pi.shutdownTimeout)
+	defer cancel()
+
+	_, err := pi.Shutdown(ctx)
+	return err
+}
+
+// Shutdown stops accepting new connections and waits for active ones,
+// including hijacked CONNECT tunnels and SOCKS5 connections, to finish until
+// ctx is done. Connections still open then are force-closed. Returns number
+// of connections which were cut.
+func (pi *ProxyInstance) Shutdown(ctx context.Context) (int, error) {
+	// Lock is held only to mark instance stopped, waiting for connections
+	// must not block UpdateUpstream and other callers
+	pi.mu.Lock()
+	if pi.stopped {
+		pi.mu.Unlock()
+		return 0, nil
+	}
+	pi.stopped = true
+	server, cancel, auth := pi.Server, pi.Cancel, pi.auth
+
+	pi.logger.Info("Stopping proxy instance")
+
+	// Stop accepting new connections
+	pi.closeListener()
+	pi.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+
+	// Wait for plain HTTP requests and tunnels to finish
+	var shutdownErr error
+	if server != nil {
+		shutdownErr = server.Shutdown(ctx)
+	}
+	cut := pi.conns.Drain(ctx)
+	if shutdownErr != nil {
+		server.Close()
+	}
+
+	// Close auth provider
+	if auth != nil {
+		auth.Close()
+	}
+
+	if cut > 0 {
+		pi.logger.Warning("Proxy instance stopped, %d connection(s) cut after drain deadline", cut)
+	} else {
+		pi.logger.Info("Proxy instance stopped")
+	}
+	return cut, nil
+}
+
+// closeListener stops accepting new connections and frees the port, while
+// active connections keep running
+func (pi *ProxyInstance) closeListener() {
+	if pi.Listener != nil {
+		pi.Listener.Close()
 	}
 }
@@ -0,0 +1,126 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+// Lifecycle statuses of a proxy
+const (
+	StatusActive   = "active"
+	StatusPaused   = "paused"   // Taken out of rotation temporarily
+	StatusDisabled = "disabled" // Taken out of rotation until resumed
+)
+
+// ErrProxyNotActive is returned when paused or disabled proxy is rotated
+var ErrProxyNotActive = errors.New("proxy is not active")
+
+// PauseProxy stops instance of proxy, keeping its row, port and
+// credentials, and excludes it from auto-reset until it is resumed
+func (m *Manager) PauseProxy(ctx context.Context, id uint) (*models.Proxy, error) {
+	return m.setStatus(ctx, id, StatusPaused)
+}
+
+// DisableProxy works like PauseProxy, but marks proxy as disabled
+func (m *Manager) DisableProxy(ctx context.Context, id uint) (*models.Proxy, error) {
+	return m.setStatus(ctx, id, StatusDisabled)
+}
+
+// ResumeProxy starts instance of paused or disabled proxy on its port and
+// returns it to auto-reset. Failure state of auto-reset is cleared even if
+// proxy is already active, so proxy auto-reset gave up on is retried.
+func (m *Manager) ResumeProxy(ctx context.Context, id uint) (*models.Proxy, error) {
+	return m.setStatus(ctx, id, StatusActive)
+}
+
+// setStatus waits for running rotation of proxy, so rotation never swaps
+// upstream into instance which was just stopped
+func (m *Manager) setStatus(ctx context.Context, id uint, status string) (*models.Proxy, error) {
+	unlock, err := m.lockRotation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	proxy, err := m.GetProxyByID(id)
+	if err != nil {
+		return nil, err
+	}
+	resume := status == StatusActive
+	failed := proxy.ResetDisabled || proxy.ConsecutiveFailures > 0
+	if proxy.Status == status && !(resume && failed) {
+		return proxy, nil
+	}
+
+	_, running := m.instances[id]
+	if resume {
+		// Start listener first, so proxy stays paused if its port is gone
+		if err := m.startInstance(proxy); err != nil {
+			return nil, err
+		}
+	}
+
+	query := "UPDATE proxies SET status = ? WHERE id = ?"
+	if resume {
+		query = `
+			UPDATE proxies
+			SET status = ?, last_error = '', consecutive_failures = 0, next_attempt_at = NULL, reset_disabled = 0
+			WHERE id = ?
+		`
+	}
+	if _, err := m.db.Exec(query, status, id); err != nil {
+		if resume && !running {
+			m.stopInBackground(m.instances[id])
+			delete(m.instances, id)
+		}
+		return nil, fmt.Errorf("failed to save status: %w", err)
+	}
+	proxy.Status = status
+	if resume {
+		proxy.LastError = ""
+		proxy.ConsecutiveFailures = 0
+		proxy.NextAttemptAt = nil
+		proxy.ResetDisabled = false
+	}
+	proxy.NextResetAt = plannedResetAt(proxy)
+
+	if !resume {
+		if instance, ok := m.instances[id]; ok {
+			m.stopInBackground(instance)
+			delete(m.instances, id)
+		}
+		m.clearFailures(id)
+	}
+
+	log.Printf("Proxy %d is %s", id, status)
+	m.emit(ProxyUpdated, id, proxy)
+
+	return proxy, nil
+}
+
+// startInstance creates and starts instance of proxy unless it is already
+// running. Caller must hold m.mu.
+func (m *Manager) startInstance(proxy *models.Proxy) error {
+	if _, ok := m.instances[proxy.ID]; ok {
+		return nil
+	}
+
+	instance, err := m.newInstance(proxy)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy instance: %w", err)
+	}
+
+	if err := instance.Start(m.ctx); err != nil {
+		return fmt.Errorf("failed to start proxy instance: %w", err)
+	}
+
+	m.instances[proxy.ID] = instance
+	return nil
+}
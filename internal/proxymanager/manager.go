@@ -3,9 +3,15 @@ package proxymanager
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go-forward-proxy/internal/config"
@@ -13,54 +19,473 @@ import (
 	"go-forward-proxy/internal/proxyservices"
 )
 
+// proxyColumns lists columns read by scanProxy, in order
+const proxyColumns = `id, proxy_str, api_key, service_type, min_time_reset, last_reset_at, created_at, port, mode, username, password,
+	last_error, consecutive_failures, next_attempt_at, reset_disabled, expires_at, next_reset_allowed_at, status, reset_schedule, egress_ip, egress_error,
+	ip_freshness_window, ip_freshness_global, provider_options, upstream, upstream_socks5, upstream_protocol`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanProxy(row rowScanner) (models.Proxy, error) {
+	var (
+		p                  models.Proxy
+		nextAttemptAt      sql.NullTime
+		expiresAt          sql.NullTime
+		nextResetAllowedAt sql.NullTime
+		providerOptions    string
+		upstream           string
+		upstreamSOCKS5     string
+	)
+	err := row.Scan(&p.ID, &p.ProxyStr, &p.APIKey, &p.ServiceType, &p.MinTimeReset, &p.LastResetAt, &p.CreatedAt, &p.Port, &p.Mode, &p.Username, &p.Password,
+		&p.LastError, &p.ConsecutiveFailures, &nextAttemptAt, &p.ResetDisabled, &expiresAt, &nextResetAllowedAt, &p.Status, &p.ResetSchedule, &p.EgressIP, &p.EgressError,
+		&p.IPFreshnessWindow, &p.IPFreshnessGlobal, &providerOptions, &upstream, &upstreamSOCKS5, &p.UpstreamProtocol)
+	if nextAttemptAt.Valid {
+		p.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if expiresAt.Valid {
+		p.ExpiresAt = &expiresAt.Time
+		p.Expired = p.IsExpired(time.Now())
+	}
+	if nextResetAllowedAt.Valid {
+		p.NextResetAllowedAt = &nextResetAllowedAt.Time
+	}
+	if err == nil && providerOptions != "" {
+		if err = json.Unmarshal([]byte(providerOptions), &p.ProviderOptions); err != nil {
+			err = fmt.Errorf("invalid provider options of proxy %d: %w", p.ID, err)
+		}
+	}
+	// proxy_str column is kept only for rows which couldn't be migrated,
+	// display forms are derived from upstreams
+	if err == nil && upstream != "" {
+		if err = json.Unmarshal([]byte(upstream), &p.Upstream); err != nil {
+			err = fmt.Errorf("invalid upstream of proxy %d: %w", p.ID, err)
+		} else {
+			p.ProxyStr = p.Upstream.String()
+		}
+	}
+	if err == nil && upstreamSOCKS5 != "" {
+		if err = json.Unmarshal([]byte(upstreamSOCKS5), &p.UpstreamSOCKS5); err != nil {
+			err = fmt.Errorf("invalid SOCKS5 upstream of proxy %d: %w", p.ID, err)
+		} else {
+			p.ProxySOCKS5Str = p.UpstreamSOCKS5.String()
+		}
+	}
+	if err == nil {
+		p.NextResetAt = plannedResetAt(&p)
+	}
+	return p, err
+}
+
+// providerOptionsValue returns provider options for storing, empty string
+// if proxy uses provider defaults
+func providerOptionsValue(options proxyservices.Options) (string, error) {
+	if len(options) == 0 {
+		return "", nil
+	}
+	data, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", proxyservices.ErrInvalidOptions, err)
+	}
+	return string(data), nil
+}
+
+// expiresAtValue returns provider key expiry for storing, nil if provider
+// didn't report it
+func expiresAtValue(info *proxyservices.ProxyInfo) *time.Time {
+	if info.ExpiresAt.IsZero() {
+		return nil
+	}
+	return &info.ExpiresAt
+}
+
+// nextResetAllowedValue returns time until which provider doesn't allow
+// another rotation, nil if provider didn't report cooldown
+func nextResetAllowedValue(info *proxyservices.ProxyInfo, now time.Time) *time.Time {
+	if info.NextResetAfter <= 0 {
+		return nil
+	}
+	allowedAt := now.Add(time.Duration(info.NextResetAfter) * time.Second)
+	return &allowedAt
+}
+
+var (
+	ErrProxyNotFound    = errors.New("proxy not found")
+	ErrInstanceNotFound = errors.New("proxy instance not running")
+	ErrUnknownService   = errors.New("unknown service type")
+)
+
+// StartAllError reports proxies which could not be started
+type StartAllError struct {
+	Failed map[uint]error
+}
+
+func (e *StartAllError) Error() string {
+	parts := make([]string, 0, len(e.Failed))
+	for id, err := range e.Failed {
+		parts = append(parts, fmt.Sprintf("proxy %d: %v", id, err))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%d proxy instance(s) failed to start: %s", len(e.Failed), strings.Join(parts, "; "))
+}
+
 type Manager struct {
-	instances     map[uint]*ProxyInstance
-	db            *sql.DB
-	config        *config.Config
-	proxyServices map[string]proxyservices.ProxyService
-	ctx           context.Context
-	mu            sync.RWMutex
+	instances map[uint]*ProxyInstance
+	db        *sql.DB
+	config    *config.Config
+	services  *proxyservices.Registry
+	ctx       context.Context
+	ports     *portAllocator
+	gateway   *Gateway
+	usage     *UsageRecorder
+	egress    *EgressVerifier
+	mu        sync.RWMutex
+
+	subscribersMu sync.Mutex
+	subscribers   []func(ProxyEvent)
+
+	failuresMu     sync.Mutex
+	failures       map[uint]*failureCounter
+	failureBudget  int
+	failureWindow  time.Duration
+	resetRequester func(proxyID uint)
+
+	// rotations holds proxies being rotated, closed channel wakes callers
+	// waiting in lockRotation
+	rotationsMu sync.Mutex
+	rotations   map[uint]chan struct{}
 }
 
-func NewManager(db *sql.DB, cfg *config.Config, services map[string]proxyservices.ProxyService) *Manager {
+func NewManager(db *sql.DB, cfg *config.Config, services *proxyservices.Registry) *Manager {
 	return &Manager{
 		instances:     make(map[uint]*ProxyInstance),
 		db:            db,
 		config:        cfg,
-		proxyServices: services,
+		services:      services,
 		ctx:           context.Background(),
+		ports:         newPortAllocator(cfg.PortRangeStart, cfg.PortRangeEnd),
+		failures:      make(map[uint]*failureCounter),
+		failureBudget: cfg.UpstreamFailureBudget,
+		failureWindow: time.Duration(cfg.UpstreamFailureWindow) * time.Second,
+		rotations:     make(map[uint]chan struct{}),
 	}
 }
 
-func (m *Manager) UpsertProxy(apiKey, serviceType string, minTimeReset int) (*models.Proxy, error) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// ServiceTypes returns service types of registered providers
+func (m *Manager) ServiceTypes() []string {
+	return m.services.Names()
+}
+
+// ProviderOptions returns options provider of given service type offers,
+// e.g. locations and ISPs
+func (m *Manager) ProviderOptions(ctx context.Context, serviceType string) (*proxyservices.ProviderOptions, error) {
+	service, ok := m.services.Get(serviceType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, serviceType)
+	}
+	return proxyservices.ListProviderOptions(ctx, service)
+}
+
+// SetUsageRecorder sets recorder counting traffic of instances and gateway.
+// Must be called before instances are started.
+func (m *Manager) SetUsageRecorder(ur *UsageRecorder) {
+	m.usage = ur
+}
+
+// SetResetRequester sets function called when proxy needs early reset
+// because its upstream failure budget is exhausted
+func (m *Manager) SetResetRequester(fn func(proxyID uint)) {
+	m.failuresMu.Lock()
+	defer m.failuresMu.Unlock()
+	m.resetRequester = fn
+}
+
+// ReportUpstreamFailure records upstream dial failure seen on client traffic
+// and requests early reset once proxy's failure budget is exhausted
+func (m *Manager) ReportUpstreamFailure(proxyID uint, kind FailureKind, err error) {
+	if m.failureBudget <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	m.failuresMu.Lock()
+	counter, ok := m.failures[proxyID]
+	if !ok || now.Sub(counter.windowStart) > m.failureWindow {
+		counter = &failureCounter{
+			windowStart: now,
+			byKind:      make(map[FailureKind]int),
+		}
+		m.failures[proxyID] = counter
+	}
+	counter.count++
+	counter.byKind[kind]++
+
+	exhausted := counter.count >= m.failureBudget
+	if exhausted {
+		delete(m.failures, proxyID)
+	}
+	requester := m.resetRequester
+	m.failuresMu.Unlock()
+
+	if !exhausted {
+		return
+	}
+
+	log.Printf("Proxy %d exhausted upstream failure budget (%d failures %v, last: %v), requesting reset",
+		proxyID, counter.count, counter.byKind, err)
+	if requester != nil {
+		requester(proxyID)
+	}
+}
 
+func (m *Manager) clearFailures(proxyID uint) {
+	m.failuresMu.Lock()
+	defer m.failuresMu.Unlock()
+	delete(m.failures, proxyID)
+}
+
+// newInstance creates proxy instance wired to manager callbacks
+func (m *Manager) newInstance(proxy *models.Proxy) (*ProxyInstance, error) {
+	instance, err := NewProxyInstance(proxy, m.config)
+	if err != nil {
+		return nil, err
+	}
+
+	instance.onUpstreamFailure = m.ReportUpstreamFailure
+	instance.onRotate = m.RotateProxy
+	instance.usage = m.usage
+	return instance, nil
+}
+
+// usedPorts returns ports assigned to proxies other than excludeID
+func (m *Manager) usedPorts(excludeID uint) (map[int]bool, error) {
+	rows, err := m.db.Query("SELECT port FROM proxies WHERE id != ? AND port > 0", excludeID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query used ports: %w", err)
+	}
+	defer rows.Close()
+
+	used := make(map[int]bool)
+	for rows.Next() {
+		var port int
+		if err := rows.Scan(&port); err != nil {
+			return nil, fmt.Errorf("failed to scan port: %w", err)
+		}
+		used[port] = true
+	}
+
+	return used, rows.Err()
+}
+
+// UpsertParams describes proxy to create or update
+type UpsertParams struct {
+	APIKey      string
+	ServiceType string
+	// MinTimeReset is interval of resets in seconds, required unless
+	// proxy has ResetSchedule. Nil means 0 on insert (or keep current
+	// interval on update).
+	MinTimeReset *int
+	// ResetSchedule optionally sets cron schedule of resets replacing
+	// MinTimeReset interval, empty means reset by interval. Nil means
+	// reset by interval on insert (or keep current schedule on update).
+	ResetSchedule *string
+	// IPFreshnessWindow optionally rejects exit IPs used within this many
+	// seconds on rotation, 0 accepts any IP. IPFreshnessGlobal checks IPs
+	// used by all proxies instead of this one only. Nil means 0 and false
+	// on insert (or keep current setting on update).
+	IPFreshnessWindow *int
+	IPFreshnessGlobal *bool
+	// ProviderOptions are passed to provider on new proxy requests, e.g.
+	// location and ISP. Nil means provider defaults on insert (or keep
+	// current options on update), empty options reset them to defaults.
+	ProviderOptions proxyservices.Options
+	// Port optionally requests specific listener port, 0 means allocate
+	// automatically (or keep current port on update)
+	Port int
+	// Mode selects listener protocols, empty means "http" on insert
+	// (or keep current mode on update)
+	Mode string
+	// UpstreamProtocol selects provider endpoint instance dials, empty
+	// means "http" on insert (or keep current protocol on update)
+	UpstreamProtocol string
+}
+
+// UpsertProxy creates proxy or updates existing one with the same api_key.
+// Provider calls are cancelled when ctx is done.
+func (m *Manager) UpsertProxy(ctx context.Context, params UpsertParams) (*models.Proxy, error) {
 	// Get proxy service
-	service, ok := m.proxyServices[serviceType]
+	service, ok := m.services.Get(params.ServiceType)
 	if !ok {
-		return nil, fmt.Errorf("unknown service type: %s", serviceType)
+		return nil, fmt.Errorf("%w: %s", ErrUnknownService, params.ServiceType)
 	}
 
-	// Check if proxy exists by api_key
-	var existingID uint
-	err := m.db.QueryRow("SELECT id FROM proxies WHERE api_key = ? LIMIT 1", apiKey).Scan(&existingID)
+	if params.Mode != "" && !ValidMode(params.Mode) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidMode, params.Mode)
+	}
 
-	if err == sql.ErrNoRows {
+	if params.UpstreamProtocol != "" && !ValidUpstreamProtocol(params.UpstreamProtocol) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidUpstreamProtocol, params.UpstreamProtocol)
+	}
+
+	if params.IPFreshnessWindow != nil && *params.IPFreshnessWindow < 0 {
+		return nil, ErrInvalidFreshnessWindow
+	}
+	if params.IPFreshnessWindow != nil && *params.IPFreshnessWindow > 0 && m.egress == nil {
+		return nil, ErrFreshnessUnavailable
+	}
+
+	if err := proxyservices.ValidateOptions(service, params.ProviderOptions); err != nil {
+		return nil, err
+	}
+
+	existingID, unlock, err := m.lockUpsert(ctx, params.APIKey)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if existingID == 0 {
 		// INSERT flow: proxy does NOT exist
-		return m.insertNewProxy(apiKey, serviceType, minTimeReset, service)
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to check existing proxy: %w", err)
+		return m.insertNewProxy(ctx, params, service)
 	}
 
 	// UPDATE flow: proxy EXISTS
-	return m.updateExistingProxy(existingID, apiKey, minTimeReset, service)
+	return m.updateExistingProxy(ctx, existingID, params, service)
+}
+
+// lockUpsert takes rotation lock of proxy with given api_key, if there is
+// one, and then manager lock. Rotations take manager lock while holding
+// their rotation lock, so it must be taken first. Returns ID of existing
+// proxy, 0 if there is none.
+func (m *Manager) lockUpsert(ctx context.Context, apiKey string) (uint, func(), error) {
+	for {
+		id, err := m.proxyIDByAPIKey(apiKey)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		unlockRotation := func() {}
+		if id != 0 {
+			if unlockRotation, err = m.lockRotation(ctx, id); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		m.mu.Lock()
+		current, err := m.proxyIDByAPIKey(apiKey)
+		if err == nil && current == id {
+			return id, func() {
+				m.mu.Unlock()
+				unlockRotation()
+			}, nil
+		}
+		m.mu.Unlock()
+		unlockRotation()
+		if err != nil {
+			return 0, nil, err
+		}
+		// Proxy was created or deleted meanwhile, lock it again
+	}
+}
+
+// proxyIDByAPIKey returns ID of proxy with given api_key, 0 if there is none
+func (m *Manager) proxyIDByAPIKey(apiKey string) (uint, error) {
+	var id uint
+	err := m.db.QueryRow("SELECT id FROM proxies WHERE api_key = ? LIMIT 1", apiKey).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to check existing proxy: %w", err)
+	}
+	return id, nil
+}
+
+// upsertSettings are reset settings proxy has after upsert
+type upsertSettings struct {
+	minTimeReset      int
+	resetSchedule     string
+	ipFreshnessWindow int
+	ipFreshnessGlobal bool
+	providerOptions   proxyservices.Options
+}
+
+// resolveSettings applies settings given in params over settings of
+// existing proxy, nil for new one. Settings left out are kept.
+func resolveSettings(params UpsertParams, existing *models.Proxy) (upsertSettings, error) {
+	var settings upsertSettings
+	if existing != nil {
+		settings = upsertSettings{
+			minTimeReset:      existing.MinTimeReset,
+			resetSchedule:     existing.ResetSchedule,
+			ipFreshnessWindow: existing.IPFreshnessWindow,
+			ipFreshnessGlobal: existing.IPFreshnessGlobal,
+			providerOptions:   existing.ProviderOptions,
+		}
+	}
+
+	if params.MinTimeReset != nil {
+		settings.minTimeReset = *params.MinTimeReset
+	}
+	if params.ResetSchedule != nil {
+		settings.resetSchedule = *params.ResetSchedule
+	}
+	if params.IPFreshnessWindow != nil {
+		settings.ipFreshnessWindow = *params.IPFreshnessWindow
+	}
+	if params.IPFreshnessGlobal != nil {
+		settings.ipFreshnessGlobal = *params.IPFreshnessGlobal
+	}
+	if params.ProviderOptions != nil {
+		settings.providerOptions = params.ProviderOptions
+	}
+
+	if err := validateResetTiming(settings.resetSchedule, settings.minTimeReset); err != nil {
+		return upsertSettings{}, err
+	}
+	return settings, nil
 }
 
 // insertNewProxy handles the INSERT flow when proxy doesn't exist
-func (m *Manager) insertNewProxy(apiKey, serviceType string, minTimeReset int, service proxyservices.ProxyService) (*models.Proxy, error) {
+func (m *Manager) insertNewProxy(ctx context.Context, params UpsertParams, service proxyservices.ProxyService) (*models.Proxy, error) {
+	mode := params.Mode
+	if mode == "" {
+		mode = ModeHTTP
+	}
+	protocol := params.UpstreamProtocol
+	if protocol == "" {
+		protocol = UpstreamHTTP
+	}
+
+	settings, err := resolveSettings(params, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allocate listener port before calling provider
+	used, err := m.usedPorts(0)
+	if err != nil {
+		return nil, err
+	}
+	port, err := m.ports.allocate(params.Port, used)
+	if err != nil {
+		return nil, err
+	}
+
+	username, password, err := GenerateCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	providerOptions, err := providerOptionsValue(settings.providerOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get current proxy info from service
-	proxyInfo, err := service.GetCurrentProxy(apiKey)
+	proxyInfo, err := service.GetCurrentProxy(ctx, params.APIKey)
 	now := time.Now()
 	var lastResetAt time.Time
 
@@ -69,7 +494,7 @@ func (m *Manager) insertNewProxy(apiKey, serviceType string, minTimeReset int, s
 		// If GetCurrentProxy returns ErrNoCurrentProxy (code=27), call GetNewProxy to request a new proxy
 		if err.Error() == "no current proxy available, need to call GetNewProxy" || errors.Is(err, proxyservices.ErrNoCurrentProxy) {
 			fmt.Println("No current proxy available, calling GetNewProxy")
-			proxyInfo, err = service.GetNewProxy(apiKey)
+			proxyInfo, err = service.GetNewProxy(ctx, params.APIKey, settings.providerOptions)
 			if err != nil {
 				fmt.Println("Failed to get new proxy: %w", err)
 				return nil, fmt.Errorf("failed to get new proxy: %w", err)
@@ -85,11 +510,26 @@ func (m *Manager) insertNewProxy(apiKey, serviceType string, minTimeReset int, s
 		lastResetAt = now.Add(-time.Duration(proxyInfo.NextResetAfter) * time.Second)
 	}
 
+	if _, err := selectUpstream(proxyInfo.Upstream, proxyInfo.SOCKS5, protocol); err != nil {
+		return nil, err
+	}
+	upstream, err := upstreamValue(proxyInfo.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	upstreamSOCKS5, err := upstreamValue(proxyInfo.SOCKS5)
+	if err != nil {
+		return nil, err
+	}
+
 	// Insert into database with calculated last_reset_at
 	result, err := m.db.Exec(`
-		INSERT INTO proxies (proxy_str, api_key, service_type, min_time_reset, last_reset_at, created_at)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, proxyInfo.ProxyStr, apiKey, serviceType, minTimeReset, lastResetAt, now)
+		INSERT INTO proxies (proxy_str, api_key, service_type, min_time_reset, reset_schedule, last_reset_at, created_at, port, mode, username, password, expires_at, next_reset_allowed_at,
+			ip_freshness_window, ip_freshness_global, provider_options, upstream, upstream_socks5, proxy_socks5_str, upstream_protocol)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, upstreamDisplay(proxyInfo.Upstream), params.APIKey, params.ServiceType, settings.minTimeReset, settings.resetSchedule, lastResetAt, now, port, mode, username, password,
+		expiresAtValue(proxyInfo), nextResetAllowedValue(proxyInfo, now), settings.ipFreshnessWindow, settings.ipFreshnessGlobal,
+		providerOptions, upstream, upstreamSOCKS5, upstreamDisplay(proxyInfo.SOCKS5), protocol)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to insert proxy in database: %w", err)
@@ -101,17 +541,35 @@ func (m *Manager) insertNewProxy(apiKey, serviceType string, minTimeReset int, s
 	}
 
 	proxy := &models.Proxy{
-		ID:           uint(id),
-		ProxyStr:     proxyInfo.ProxyStr,
-		APIKey:       apiKey,
-		ServiceType:  serviceType,
-		MinTimeReset: minTimeReset,
-		LastResetAt:  lastResetAt,
-		CreatedAt:    now,
+		ID:            uint(id),
+		ProxyStr:      upstreamDisplay(proxyInfo.Upstream),
+		APIKey:        params.APIKey,
+		ServiceType:   params.ServiceType,
+		MinTimeReset:  settings.minTimeReset,
+		ResetSchedule: settings.resetSchedule,
+		LastResetAt:   lastResetAt,
+		CreatedAt:     now,
+		Port:          port,
+		Mode:          mode,
+		Username:      username,
+		Password:      password,
+		Status:        StatusActive,
+		ExpiresAt:     expiresAtValue(proxyInfo),
+
+		NextResetAllowedAt: nextResetAllowedValue(proxyInfo, now),
+		IPFreshnessWindow:  settings.ipFreshnessWindow,
+		IPFreshnessGlobal:  settings.ipFreshnessGlobal,
+		ProviderOptions:    settings.providerOptions,
+		Upstream:           proxyInfo.Upstream,
+		UpstreamSOCKS5:     proxyInfo.SOCKS5,
+		ProxySOCKS5Str:     upstreamDisplay(proxyInfo.SOCKS5),
+		UpstreamProtocol:   protocol,
 	}
+	proxy.Expired = proxy.IsExpired(now)
+	proxy.NextResetAt = plannedResetAt(proxy)
 
 	// Create and start proxy instance
-	instance, err := NewProxyInstance(proxy.ID, proxy.ProxyStr, proxy.ServiceType, m.config)
+	instance, err := m.newInstance(proxy)
 	if err != nil {
 		// Rollback database creation
 		m.db.Exec("DELETE FROM proxies WHERE id = ?", id)
@@ -126,21 +584,61 @@ func (m *Manager) insertNewProxy(apiKey, serviceType string, minTimeReset int, s
 
 	// Store instance in map
 	m.instances[proxy.ID] = instance
+	m.emit(ProxyCreated, proxy.ID, proxy)
+
+	// Record egress IP new proxy starts with
+	m.verifyEgressInBackground(proxy)
 
 	return proxy, nil
 }
 
 // updateExistingProxy handles the UPDATE flow when proxy already exists
-func (m *Manager) updateExistingProxy(proxyID uint, apiKey string, minTimeReset int, service proxyservices.ProxyService) (*models.Proxy, error) {
+func (m *Manager) updateExistingProxy(ctx context.Context, proxyID uint, params UpsertParams, service proxyservices.ProxyService) (*models.Proxy, error) {
+	existing, err := m.GetProxyByID(proxyID)
+	if err != nil {
+		return nil, err
+	}
+
+	settings, err := resolveSettings(params, existing)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate port change before calling provider
+	port := existing.Port
+	if params.Port != 0 && params.Port != existing.Port {
+		used, err := m.usedPorts(proxyID)
+		if err != nil {
+			return nil, err
+		}
+		if port, err = m.ports.allocate(params.Port, used); err != nil {
+			return nil, err
+		}
+	}
+
+	mode := existing.Mode
+	if params.Mode != "" {
+		mode = params.Mode
+	}
+	protocol := existing.UpstreamProtocol
+	if params.UpstreamProtocol != "" {
+		protocol = params.UpstreamProtocol
+	}
+
+	providerOptions, err := providerOptionsValue(settings.providerOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	// Get current proxy info from service
-	proxyInfo, err := service.GetCurrentProxy(apiKey)
+	proxyInfo, err := service.GetCurrentProxy(ctx, params.APIKey)
 	now := time.Now()
 	var lastResetAt time.Time
 
 	if err != nil {
 		// If GetCurrentProxy returns ErrNoCurrentProxy (code=27), call GetNewProxy to request a new proxy
 		if err.Error() == "no current proxy available, need to call GetNewProxy" || errors.Is(err, proxyservices.ErrNoCurrentProxy) {
-			proxyInfo, err = service.GetNewProxy(apiKey)
+			proxyInfo, err = service.GetNewProxy(ctx, params.APIKey, settings.providerOptions)
 			if err != nil {
 				return nil, fmt.Errorf("failed to get new proxy: %w", err)
 			}
@@ -154,22 +652,52 @@ func (m *Manager) updateExistingProxy(proxyID uint, apiKey string, minTimeReset
 		lastResetAt = now.Add(-time.Duration(proxyInfo.NextResetAfter) * time.Second)
 	}
 
-	// Update database: proxy_str, min_time_reset, last_reset_at
+	selected, err := selectUpstream(proxyInfo.Upstream, proxyInfo.SOCKS5, protocol)
+	if err != nil {
+		return nil, err
+	}
+	upstream, err := upstreamValue(proxyInfo.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	upstreamSOCKS5, err := upstreamValue(proxyInfo.SOCKS5)
+	if err != nil {
+		return nil, err
+	}
+
+	// Update database: proxy_str, min_time_reset, reset_schedule,
+	// last_reset_at, port, mode, upstream endpoints and protocol,
+	// expires_at, next_reset_allowed_at, IP freshness settings and
+	// provider options. Provider accepted the key again, so reset failure
+	// state starts over.
 	_, err = m.db.Exec(`
 		UPDATE proxies
-		SET proxy_str = ?, min_time_reset = ?, last_reset_at = ?
+		SET proxy_str = ?, proxy_socks5_str = ?, upstream = ?, upstream_socks5 = ?, upstream_protocol = ?, min_time_reset = ?, reset_schedule = ?, last_reset_at = ?, port = ?, mode = ?,
+			expires_at = COALESCE(?, expires_at), next_reset_allowed_at = ?, ip_freshness_window = ?, ip_freshness_global = ?,
+			provider_options = ?, last_error = '', consecutive_failures = 0, next_attempt_at = NULL, reset_disabled = 0
 		WHERE id = ?
-	`, proxyInfo.ProxyStr, minTimeReset, lastResetAt, proxyID)
+	`, upstreamDisplay(proxyInfo.Upstream), upstreamDisplay(proxyInfo.SOCKS5), upstream, upstreamSOCKS5, protocol, settings.minTimeReset, settings.resetSchedule, lastResetAt, port, mode, expiresAtValue(proxyInfo), nextResetAllowedValue(proxyInfo, now),
+		settings.ipFreshnessWindow, settings.ipFreshnessGlobal, providerOptions, proxyID)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to update proxy in database: %w", err)
 	}
 
-	// Update running instance's upstream if instance is running
-	if instance, ok := m.instances[proxyID]; ok {
-		if err := instance.UpdateUpstream(proxyInfo.ProxyStr); err != nil {
+	instance, running := m.instances[proxyID]
+	switch {
+	case existing.Status != StatusActive:
+		// Paused proxy picks new port, mode and upstream up when resumed
+	case port != existing.Port || mode != existing.Mode:
+		// Listener changed: replace instance with one serving new port/mode
+		if err := m.restartInstance(proxyID); err != nil {
+			return nil, fmt.Errorf("failed to restart proxy instance on port %d (mode: %s): %w", port, mode, err)
+		}
+	case running:
+		// Update running instance's upstream if instance is running
+		if err := instance.UpdateUpstream(selected.URL()); err != nil {
 			return nil, fmt.Errorf("failed to update proxy instance upstream: %w", err)
 		}
+		m.clearFailures(proxyID)
 	}
 
 	// Get updated proxy from database to return
@@ -177,37 +705,61 @@ func (m *Manager) updateExistingProxy(proxyID uint, apiKey string, minTimeReset
 	if err != nil {
 		return nil, fmt.Errorf("failed to get updated proxy: %w", err)
 	}
+	m.emit(ProxyUpdated, proxyID, proxy)
+
+	if proxy.ProxyStr != existing.ProxyStr || proxy.UpstreamProtocol != existing.UpstreamProtocol {
+		m.verifyEgressInBackground(proxy)
+	}
 
 	return proxy, nil
 }
 
-func (m *Manager) DeleteProxy(id uint) error {
+func (m *Manager) DeleteProxy(id uint, purge bool) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	// Stop instance if running
 	if instance, ok := m.instances[id]; ok {
-		if err := instance.Stop(); err != nil {
-			return fmt.Errorf("failed to stop proxy instance: %w", err)
-		}
+		m.stopInBackground(instance)
 		delete(m.instances, id)
 	}
+	m.clearFailures(id)
+
+	// IP history and traffic usage are kept for reporting and IP freshness
+	// checks until their retention expires, unless purge is requested
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	// Delete from database
-	_, err := m.db.Exec("DELETE FROM proxies WHERE id = ?", id)
+	result, err := tx.Exec("DELETE FROM proxies WHERE id = ?", id)
 	if err != nil {
 		return fmt.Errorf("failed to delete proxy from database: %w", err)
 	}
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("failed to delete proxy from database: %w", err)
+	} else if n == 0 {
+		return fmt.Errorf("%w: %d", ErrProxyNotFound, id)
+	}
+	if purge {
+		if _, err := tx.Exec("DELETE FROM proxy_ip_history WHERE proxy_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete IP history of proxy: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM proxy_usage WHERE proxy_id = ?", id); err != nil {
+			return fmt.Errorf("failed to delete traffic usage of proxy: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete proxy from database: %w", err)
+	}
+	m.emit(ProxyDeleted, id, nil)
 
 	return nil
 }
 
 func (m *Manager) GetAllProxies() ([]models.Proxy, error) {
-	rows, err := m.db.Query(`
-		SELECT id, proxy_str, api_key, service_type, min_time_reset, last_reset_at, created_at
-		FROM proxies
-		ORDER BY id
-	`)
+	rows, err := m.db.Query(`SELECT ` + proxyColumns + ` FROM proxies ORDER BY id`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query proxies: %w", err)
 	}
@@ -215,8 +767,8 @@ func (m *Manager) GetAllProxies() ([]models.Proxy, error) {
 
 	var proxies []models.Proxy
 	for rows.Next() {
-		var p models.Proxy
-		if err := rows.Scan(&p.ID, &p.ProxyStr, &p.APIKey, &p.ServiceType, &p.MinTimeReset, &p.LastResetAt, &p.CreatedAt); err != nil {
+		p, err := scanProxy(rows)
+		if err != nil {
 			return nil, fmt.Errorf("failed to scan proxy: %w", err)
 		}
 		proxies = append(proxies, p)
@@ -226,12 +778,10 @@ func (m *Manager) GetAllProxies() ([]models.Proxy, error) {
 }
 
 func (m *Manager) GetProxyByID(id uint) (*models.Proxy, error) {
-	var p models.Proxy
-	err := m.db.QueryRow(`
-		SELECT id, proxy_str, api_key, service_type, min_time_reset, last_reset_at, created_at
-		FROM proxies WHERE id = ?
-	`, id).Scan(&p.ID, &p.ProxyStr, &p.APIKey, &p.ServiceType, &p.MinTimeReset, &p.LastResetAt, &p.CreatedAt)
-
+	p, err := scanProxy(m.db.QueryRow(`SELECT `+proxyColumns+` FROM proxies WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: %d", ErrProxyNotFound, id)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to get proxy: %w", err)
 	}
@@ -249,16 +799,64 @@ func (m *Manager) StartAll() error {
 		return fmt.Errorf("failed to load proxies: %w", err)
 	}
 
-	// Start instance for each proxy
+	failed := make(map[uint]error)
+
+	// Proxies without port (e.g. legacy ids past the port range) get one
+	// allocated before anything is started
+	for i := range proxies {
+		if proxies[i].Port != 0 {
+			continue
+		}
+		if err := m.assignPort(&proxies[i]); err != nil {
+			failed[proxies[i].ID] = err
+		}
+	}
+
+	// Proxies created before per-proxy credentials keep the shared login
+	// clients already use, until their credentials are rotated
+	for i := range proxies {
+		if proxies[i].Username != "" {
+			continue
+		}
+		if err := m.saveCredentials(proxies[i].ID, m.config.Username, m.config.Password); err != nil {
+			failed[proxies[i].ID] = err
+			continue
+		}
+		proxies[i].Username = m.config.Username
+		proxies[i].Password = m.config.Password
+	}
+
+	var shared []string
 	for _, proxy := range proxies {
-		instance, err := NewProxyInstance(proxy.ID, proxy.ProxyStr, proxy.ServiceType, m.config)
+		if proxy.Username == m.config.Username && proxy.Password == m.config.Password {
+			shared = append(shared, strconv.FormatUint(uint64(proxy.ID), 10))
+		}
+	}
+	if len(shared) > 0 {
+		log.Printf("WARNING: proxies %s still use the shared PROXY_USERNAME/PROXY_PASSWORD login, rotate their credentials to give each its own login", strings.Join(shared, ", "))
+	}
+
+	// Start instance for each active proxy
+	for _, proxy := range proxies {
+		if _, ok := failed[proxy.ID]; ok {
+			continue
+		}
+		if proxy.Status != StatusActive {
+			log.Printf("Proxy %d is %s, not starting its instance", proxy.ID, proxy.Status)
+			continue
+		}
+		if !m.ports.inRange(proxy.Port) {
+			log.Printf("Proxy %d uses port %d outside of configured range %d-%d", proxy.ID, proxy.Port, m.ports.start, m.ports.end)
+		}
+
+		instance, err := m.newInstance(&proxy)
 		if err != nil {
-			fmt.Printf("Failed to create proxy instance %d: %v\n", proxy.ID, err)
+			failed[proxy.ID] = fmt.Errorf("failed to create proxy instance: %w", err)
 			continue
 		}
 
 		if err := instance.Start(m.ctx); err != nil {
-			fmt.Printf("Failed to start proxy instance %d: %v\n", proxy.ID, err)
+			failed[proxy.ID] = fmt.Errorf("failed to start proxy instance: %w", err)
 			continue
 		}
 
@@ -266,33 +864,265 @@ func (m *Manager) StartAll() error {
 		fmt.Printf("Started proxy instance %d on port %d\n", proxy.ID, instance.Port)
 	}
 
+	if len(failed) > 0 {
+		return &StartAllError{Failed: failed}
+	}
+
 	return nil
 }
 
-func (m *Manager) StopAll() error {
+// RotateCredentials replaces client credentials of proxy. Empty username
+// or password are generated. Running instance picks them up immediately.
+func (m *Manager) RotateCredentials(id uint, username, password string) (*models.Proxy, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	for id, instance := range m.instances {
-		if err := instance.Stop(); err != nil {
-			fmt.Printf("Failed to stop proxy instance %d: %v\n", id, err)
+	if _, err := m.GetProxyByID(id); err != nil {
+		return nil, err
+	}
+
+	generatedUser, generatedPass, err := GenerateCredentials()
+	if err != nil {
+		return nil, err
+	}
+	if username == "" {
+		username = generatedUser
+	}
+	if password == "" {
+		password = generatedPass
+	}
+
+	if err := m.saveCredentials(id, username, password); err != nil {
+		return nil, err
+	}
+
+	if instance, ok := m.instances[id]; ok {
+		if err := instance.UpdateCredentials(username, password); err != nil {
+			return nil, fmt.Errorf("failed to update proxy instance credentials: %w", err)
 		}
 	}
 
-	// Clear instances map
+	proxy, err := m.GetProxyByID(id)
+	if err != nil {
+		return nil, err
+	}
+	m.emit(ProxyUpdated, id, proxy)
+
+	return proxy, nil
+}
+
+func (m *Manager) saveCredentials(id uint, username, password string) error {
+	if _, err := m.db.Exec("UPDATE proxies SET username = ?, password = ? WHERE id = ?", username, password, id); err != nil {
+		return fmt.Errorf("failed to save credentials: %w", err)
+	}
+	return nil
+}
+
+// assignPort allocates and persists port for proxy which has none
+func (m *Manager) assignPort(proxy *models.Proxy) error {
+	used, err := m.usedPorts(proxy.ID)
+	if err != nil {
+		return err
+	}
+
+	port, err := m.ports.allocate(0, used)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.db.Exec("UPDATE proxies SET port = ? WHERE id = ?", port, proxy.ID); err != nil {
+		return fmt.Errorf("failed to save port: %w", err)
+	}
+
+	log.Printf("Assigned port %d to proxy %d", port, proxy.ID)
+	proxy.Port = port
+	return nil
+}
+
+// restartInstance replaces running instance of proxy with a fresh one built
+// from database state. Caller must hold m.mu.
+func (m *Manager) restartInstance(proxyID uint) error {
+	proxy, err := m.GetProxyByID(proxyID)
+	if err != nil {
+		return err
+	}
+
+	if instance, ok := m.instances[proxyID]; ok {
+		m.stopInBackground(instance)
+		delete(m.instances, proxyID)
+	}
+
+	instance, err := m.newInstance(proxy)
+	if err != nil {
+		return fmt.Errorf("failed to create proxy instance: %w", err)
+	}
+
+	if err := instance.Start(m.ctx); err != nil {
+		return fmt.Errorf("failed to start proxy instance: %w", err)
+	}
+
+	m.instances[proxyID] = instance
+	m.clearFailures(proxyID)
+	return nil
+}
+
+// StartGateway starts load-balancing gateway listener if it is enabled
+func (m *Manager) StartGateway() error {
+	if m.config.GatewayPort == 0 {
+		return nil
+	}
+
+	gateway, err := NewGateway(m, m.config)
+	if err != nil {
+		return fmt.Errorf("failed to create gateway: %w", err)
+	}
+
+	if err := gateway.Start(m.ctx); err != nil {
+		return fmt.Errorf("failed to start gateway: %w", err)
+	}
+
+	m.mu.Lock()
+	m.gateway = gateway
+	m.mu.Unlock()
+
+	return nil
+}
+
+// stopInBackground frees instance's port right away and lets its active
+// connections drain without holding the caller
+func (m *Manager) stopInBackground(instance *ProxyInstance) {
+	instance.closeListener()
+	go func() {
+		if err := instance.Stop(); err != nil {
+			log.Printf("Failed to stop proxy instance %d: %v", instance.ProxyID, err)
+		}
+	}()
+}
+
+// StopAll shuts down gateway and all instances in parallel. Active
+// connections get until ctx is done to finish, then they are cut.
+func (m *Manager) StopAll(ctx context.Context) error {
+	m.mu.Lock()
+	gateway := m.gateway
+	instances := m.instances
+	m.gateway = nil
 	m.instances = make(map[uint]*ProxyInstance)
+	m.mu.Unlock()
+
+	var (
+		wg  sync.WaitGroup
+		cut atomic.Int64
+	)
+
+	if gateway != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cut.Add(int64(gateway.Shutdown(ctx)))
+		}()
+	}
+
+	for id, instance := range instances {
+		wg.Add(1)
+		go func(id uint, instance *ProxyInstance) {
+			defer wg.Done()
+			n, err := instance.Shutdown(ctx)
+			if err != nil {
+				log.Printf("Failed to stop proxy instance %d: %v", id, err)
+			}
+			cut.Add(int64(n))
+		}(id, instance)
+	}
+
+	wg.Wait()
+
+	if n := cut.Load(); n > 0 {
+		log.Printf("Stopped %d proxy instance(s), %d connection(s) cut after drain deadline", len(instances), n)
+	} else {
+		log.Printf("Stopped %d proxy instance(s), all connections drained", len(instances))
+	}
 
 	return nil
 }
 
-func (m *Manager) UpdateInstance(proxyID uint, newProxyStr string) error {
+// UpdateInstance swaps running instance of proxy to proxy's upstream
+func (m *Manager) UpdateInstance(proxy *models.Proxy) error {
+	m.mu.RLock()
+	instance, ok := m.instances[proxy.ID]
+	m.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrInstanceNotFound, proxy.ID)
+	}
+
+	upstream, err := proxyUpstream(proxy)
+	if err != nil {
+		return err
+	}
+	if err := instance.UpdateUpstream(upstream.URL()); err != nil {
+		return err
+	}
+
+	m.clearFailures(proxy.ID)
+	return nil
+}
+
+// ListConnections returns active connections of running proxy instance
+func (m *Manager) ListConnections(proxyID uint) ([]ConnectionInfo, error) {
 	m.mu.RLock()
 	instance, ok := m.instances[proxyID]
 	m.mu.RUnlock()
 
 	if !ok {
-		return fmt.Errorf("proxy instance %d not found", proxyID)
+		return nil, fmt.Errorf("%w: %d", ErrInstanceNotFound, proxyID)
+	}
+
+	return instance.Connections(), nil
+}
+
+// KillConnection terminates active connection of running proxy instance
+func (m *Manager) KillConnection(proxyID uint, connID uint64) error {
+	m.mu.RLock()
+	instance, ok := m.instances[proxyID]
+	m.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("%w: %d", ErrInstanceNotFound, proxyID)
+	}
+
+	return instance.KillConnection(connID)
+}
+
+// ProxyUsage returns traffic of proxy within time range
+func (m *Manager) ProxyUsage(id uint, from, to time.Time, granularity string) (*UsageReport, error) {
+	if _, err := m.GetProxyByID(id); err != nil {
+		return nil, err
+	}
+	if m.usage == nil {
+		return nil, errors.New("traffic usage recording is disabled")
+	}
+
+	return m.usage.Report(id, from, to, granularity)
+}
+
+// UsageTotals returns stored traffic of every proxy
+func (m *Manager) UsageTotals() (map[uint]UsageBytes, error) {
+	if m.usage == nil {
+		return map[uint]UsageBytes{}, nil
+	}
+
+	return m.usage.Totals()
+}
+
+// runningInstances returns snapshot of currently running instances
+func (m *Manager) runningInstances() []*ProxyInstance {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	instances := make([]*ProxyInstance, 0, len(m.instances))
+	for _, instance := range m.instances {
+		instances = append(instances, instance)
 	}
 
-	return instance.UpdateUpstream(newProxyStr)
+	return instances
 }
@@ -0,0 +1,69 @@
+package proxymanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrPortOutOfRange = errors.New("port is outside of allowed range")
+	ErrPortTaken      = errors.New("port is already in use")
+	ErrNoFreePort     = errors.New("no free port left in allowed range")
+)
+
+// portAllocator hands out listener ports from a configured range
+type portAllocator struct {
+	start int
+	end   int
+}
+
+func newPortAllocator(start, end int) *portAllocator {
+	return &portAllocator{
+		start: start,
+		end:   end,
+	}
+}
+
+func (pa *portAllocator) inRange(port int) bool {
+	return port >= pa.start && port <= pa.end
+}
+
+// allocate returns requested port if it can be used, or the lowest free
+// port in range when requested is 0. used holds ports assigned to other
+// proxies.
+func (pa *portAllocator) allocate(requested int, used map[int]bool) (int, error) {
+	if requested != 0 {
+		if !pa.inRange(requested) {
+			return 0, fmt.Errorf("%w: %d (allowed %d-%d)", ErrPortOutOfRange, requested, pa.start, pa.end)
+		}
+		if used[requested] {
+			return 0, fmt.Errorf("%w: %d is assigned to another proxy", ErrPortTaken, requested)
+		}
+		if err := checkPortFree(requested); err != nil {
+			return 0, err
+		}
+		return requested, nil
+	}
+
+	for port := pa.start; port <= pa.end; port++ {
+		if used[port] {
+			continue
+		}
+		if checkPortFree(port) == nil {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w (%d-%d)", ErrNoFreePort, pa.start, pa.end)
+}
+
+// checkPortFree verifies nothing else on the host listens on port
+func checkPortFree(port int) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return fmt.Errorf("%w: %d: %v", ErrPortTaken, port, err)
+	}
+	listener.Close()
+	return nil
+}
@@ -0,0 +1,89 @@
+package proxymanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// freePortPair returns port p such that p and p+1 are both free on host
+func freePortPair(t *testing.T) int {
+	t.Helper()
+	for i := 0; i < 20; i++ {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if port < 65535 && checkPortFree(port) == nil && checkPortFree(port+1) == nil {
+			return port
+		}
+	}
+	t.Skip("no pair of adjacent free ports found")
+	return 0
+}
+
+// occupy listens on port until test ends, like another program on host
+func occupy(t *testing.T, port int) {
+	t.Helper()
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatalf("Listen on %d: %v", port, err)
+	}
+	t.Cleanup(func() { l.Close() })
+}
+
+func TestPortAllocatorAllocate(t *testing.T) {
+	cases := []struct {
+		name      string
+		requested int // Offset from start of range, -1 for automatic
+		used      []int
+		busy      []int
+		want      int
+		wantErr   error
+	}{
+		{name: "requested port", requested: 1, want: 1},
+		{name: "requested port used by another proxy", requested: 0, used: []int{0}, wantErr: ErrPortTaken},
+		{name: "requested port busy on host", requested: 0, busy: []int{0}, wantErr: ErrPortTaken},
+		{name: "requested port outside range", requested: 2, wantErr: ErrPortOutOfRange},
+		{name: "lowest free port", requested: -1, want: 0},
+		{name: "skips port used by another proxy", requested: -1, used: []int{0}, want: 1},
+		{name: "skips port busy on host", requested: -1, busy: []int{0}, want: 1},
+		{name: "no free port left", requested: -1, used: []int{0}, busy: []int{1}, wantErr: ErrNoFreePort},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := freePortPair(t)
+			pa := newPortAllocator(start, start+1)
+
+			used := make(map[int]bool)
+			for _, offset := range tc.used {
+				used[start+offset] = true
+			}
+			for _, offset := range tc.busy {
+				occupy(t, start+offset)
+			}
+			requested := 0
+			if tc.requested >= 0 {
+				requested = start + tc.requested
+			}
+
+			got, err := pa.allocate(requested, used)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Errorf("allocate(%d) = %d, %v, want %v", requested, got, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("allocate(%d): %v", requested, err)
+			}
+			if got != start+tc.want {
+				t.Errorf("allocate(%d) = %d, want %d", requested, got, start+tc.want)
+			}
+		})
+	}
+}
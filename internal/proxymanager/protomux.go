@@ -0,0 +1,140 @@
+package proxymanager
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	socks5Version       = 0x05
+	protoDetectTimeout  = 10 * time.Second
+	protoMuxQueueLength = 16
+)
+
+// protoMux shares one listener between HTTP and SOCKS5 servers. Both
+// protocols are client-speaks-first, so connection is routed by the first
+// byte it sends: SOCKS5 greeting always starts with version byte 0x05.
+type protoMux struct {
+	root  net.Listener
+	http  *chanListener
+	socks *chanListener
+}
+
+func newProtoMux(root net.Listener) *protoMux {
+	return &protoMux{
+		root:  root,
+		http:  newChanListener(root),
+		socks: newChanListener(root),
+	}
+}
+
+// Serve accepts connections until root listener is closed
+func (pm *protoMux) Serve() {
+	for {
+		conn, err := pm.root.Accept()
+		if err != nil {
+			pm.http.closeWithError(err)
+			pm.socks.closeWithError(err)
+			return
+		}
+		go pm.route(conn)
+	}
+}
+
+func (pm *protoMux) route(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(protoDetectTimeout))
+	first, err := reader.Peek(1)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	peeked := &peekedConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	if first[0] == socks5Version {
+		pm.socks.deliver(peeked)
+	} else {
+		pm.http.deliver(peeked)
+	}
+}
+
+// peekedConn replays bytes consumed during protocol detection
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// chanListener is a net.Listener fed by protoMux
+type chanListener struct {
+	root      net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	err       error
+}
+
+func newChanListener(root net.Listener) *chanListener {
+	return &chanListener{
+		root:  root,
+		conns: make(chan net.Conn, protoMuxQueueLength),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *chanListener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return nil, l.err
+	}
+}
+
+func (l *chanListener) closeWithError(err error) {
+	l.closeOnce.Do(func() {
+		l.mu.Lock()
+		l.err = err
+		l.mu.Unlock()
+		close(l.done)
+	})
+}
+
+// Close closes root listener, so both protocols stop accepting
+func (l *chanListener) Close() error {
+	err := l.root.Close()
+	l.closeWithError(net.ErrClosed)
+	return err
+}
+
+func (l *chanListener) Addr() net.Addr {
+	return l.root.Addr()
+}
@@ -0,0 +1,99 @@
+package proxymanager
+
+import (
+	"container/heap"
+	"time"
+)
+
+// scheduledReset is a proxy waiting in reset queue
+type scheduledReset struct {
+	proxyID uint
+	at      time.Time
+	index   int
+}
+
+// resetQueue is a priority queue of proxies ordered by reset time
+type resetQueue struct {
+	items []*scheduledReset
+	byID  map[uint]*scheduledReset
+}
+
+func newResetQueue() *resetQueue {
+	return &resetQueue{
+		byID: make(map[uint]*scheduledReset),
+	}
+}
+
+// schedule adds proxy to queue or moves it to new reset time
+func (q *resetQueue) schedule(proxyID uint, at time.Time) {
+	if item, ok := q.byID[proxyID]; ok {
+		item.at = at
+		heap.Fix((*resetHeap)(q), item.index)
+		return
+	}
+
+	item := &scheduledReset{
+		proxyID: proxyID,
+		at:      at,
+	}
+	q.byID[proxyID] = item
+	heap.Push((*resetHeap)(q), item)
+}
+
+// remove drops proxy from queue
+func (q *resetQueue) remove(proxyID uint) {
+	item, ok := q.byID[proxyID]
+	if !ok {
+		return
+	}
+	heap.Remove((*resetHeap)(q), item.index)
+	delete(q.byID, proxyID)
+}
+
+// peek returns earliest scheduled reset, or nil if queue is empty
+func (q *resetQueue) peek() *scheduledReset {
+	if len(q.items) == 0 {
+		return nil
+	}
+	return q.items[0]
+}
+
+// pop removes and returns earliest scheduled reset
+func (q *resetQueue) pop() *scheduledReset {
+	item := heap.Pop((*resetHeap)(q)).(*scheduledReset)
+	delete(q.byID, item.proxyID)
+	return item
+}
+
+// resetHeap implements heap.Interface over resetQueue items
+type resetHeap resetQueue
+
+func (h *resetHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *resetHeap) Less(i, j int) bool {
+	return h.items[i].at.Before(h.items[j].at)
+}
+
+func (h *resetHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *resetHeap) Push(x any) {
+	item := x.(*scheduledReset)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *resetHeap) Pop() any {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	h.items = old[:n-1]
+	item.index = -1
+	return item
+}
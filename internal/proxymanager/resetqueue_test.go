@@ -0,0 +1,145 @@
+package proxymanager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResetQueue(t *testing.T) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return base.Add(time.Duration(minutes) * time.Minute) }
+
+	cases := []struct {
+		name  string
+		apply func(q *resetQueue)
+		want  []uint // Proxy IDs in pop order
+	}{
+		{
+			name:  "empty",
+			apply: func(q *resetQueue) {},
+		},
+		{
+			name: "ordered by reset time",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(30))
+				q.schedule(2, at(10))
+				q.schedule(3, at(20))
+			},
+			want: []uint{2, 3, 1},
+		},
+		{
+			name: "rescheduling moves proxy instead of adding it twice",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(10))
+				q.schedule(2, at(20))
+				q.schedule(1, at(30))
+			},
+			want: []uint{2, 1},
+		},
+		{
+			name: "rescheduling earlier moves proxy to front",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(10))
+				q.schedule(2, at(20))
+				q.schedule(3, at(30))
+				q.schedule(3, at(0))
+			},
+			want: []uint{3, 1, 2},
+		},
+		{
+			name: "removed proxy is not popped",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(10))
+				q.schedule(2, at(20))
+				q.schedule(3, at(30))
+				q.remove(2)
+			},
+			want: []uint{1, 3},
+		},
+		{
+			name: "removing unknown proxy is a no-op",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(10))
+				q.remove(2)
+			},
+			want: []uint{1},
+		},
+		{
+			name: "removed proxy can be scheduled again",
+			apply: func(q *resetQueue) {
+				q.schedule(1, at(10))
+				q.schedule(2, at(20))
+				q.remove(1)
+				q.schedule(1, at(30))
+			},
+			want: []uint{2, 1},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newResetQueue()
+			tc.apply(q)
+
+			var got []uint
+			for next := q.peek(); next != nil; next = q.peek() {
+				if popped := q.pop(); popped != next {
+					t.Fatalf("pop() = proxy %d, peek() returned proxy %d", popped.proxyID, next.proxyID)
+				}
+				got = append(got, next.proxyID)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("pop order = %v, want %v", got, tc.want)
+			}
+			if len(q.byID) != 0 {
+				t.Errorf("%d proxy(s) left in index of empty queue", len(q.byID))
+			}
+		})
+	}
+}
+
+func TestApplyRetryResult(t *testing.T) {
+	retryAt := time.Now().Add(time.Minute)
+
+	cases := []struct {
+		name          string
+		state         resetState
+		wantScheduled bool
+	}{
+		{name: "active proxy", state: resetState{active: true}, wantScheduled: true},
+		{name: "paused while job waited", state: resetState{}},
+		{name: "auto-reset disabled", state: resetState{active: true, disabled: true}},
+		{name: "key expired", state: resetState{active: true, expiresAt: time.Now().Add(-time.Minute)}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := tc.state
+			state.minTimeReset = time.Hour
+			state.inFlight = true
+			ars := &AutoResetService{
+				queue:  newResetQueue(),
+				states: map[uint]*resetState{1: &state},
+			}
+
+			ars.applyResult(resetResult{job: resetJob{proxyID: 1}, retryAt: retryAt})
+
+			if state.inFlight {
+				t.Errorf("proxy still in flight after result")
+			}
+			// Retry leaves what scheduler knows about proxy as it was
+			if state.minTimeReset != time.Hour || !state.nextAttemptAt.IsZero() {
+				t.Errorf("state changed by retry result: %+v", state)
+			}
+
+			next := ars.queue.peek()
+			switch {
+			case !tc.wantScheduled && next != nil:
+				t.Errorf("proxy scheduled at %v, want not scheduled", next.at)
+			case tc.wantScheduled && (next == nil || !next.at.Equal(retryAt)):
+				t.Errorf("proxy scheduled at %+v, want %v", next, retryAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+// CooldownError is returned when proxy is rotated before provider allows it
+type CooldownError struct {
+	ProxyID   uint
+	AllowedAt time.Time
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("proxy %d can't be rotated until %s", e.ProxyID, e.AllowedAt.Format(time.RFC3339))
+}
+
+// RetryAfter returns time left until rotation is allowed
+func (e *CooldownError) RetryAfter(now time.Time) time.Duration {
+	return e.AllowedAt.Sub(now)
+}
+
+// ExpiredError is returned when proxy is rotated after its provider key
+// expired
+type ExpiredError struct {
+	ProxyID   uint
+	ExpiredAt time.Time
+}
+
+func (e *ExpiredError) Error() string {
+	return fmt.Sprintf("proxy %d can't be rotated, provider key expired at %s", e.ProxyID, e.ExpiredAt.Format(time.RFC3339))
+}
+
+// lockRotation waits until no other rotation of proxy is running and
+// reserves proxy for caller. API, in-band and auto-reset rotations all go
+// through it, so provider is never asked for two upstreams at once.
+func (m *Manager) lockRotation(ctx context.Context, id uint) (unlock func(), err error) {
+	for {
+		m.rotationsMu.Lock()
+		running, ok := m.rotations[id]
+		if !ok {
+			done := make(chan struct{})
+			m.rotations[id] = done
+			m.rotationsMu.Unlock()
+
+			return func() {
+				m.rotationsMu.Lock()
+				delete(m.rotations, id)
+				m.rotationsMu.Unlock()
+				close(done)
+			}, nil
+		}
+		m.rotationsMu.Unlock()
+
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// RotateProxy forces new upstream for proxy and swaps it into running
+// instance, keeping port and credentials. Returns *CooldownError if
+// provider cooldown of the previous rotation hasn't passed yet,
+// *ExpiredError if provider key expired and ErrProxyNotActive if proxy is
+// paused or disabled. Caller
+// which waited for concurrent rotation of the same proxy gets its result
+// instead of rotating again. Provider calls are cancelled when ctx is done.
+func (m *Manager) RotateProxy(ctx context.Context, id uint) (*models.Proxy, error) {
+	requestedAt := time.Now()
+	unlock, err := m.lockRotation(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Proxy is read under the guard, so cooldown set by rotation which
+	// just finished is seen
+	proxy, err := m.GetProxyByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.LastResetAt.After(requestedAt) {
+		return proxy, nil
+	}
+	if proxy.Status != StatusActive {
+		return nil, fmt.Errorf("%w: proxy %d is %s", ErrProxyNotActive, id, proxy.Status)
+	}
+
+	now := time.Now()
+	if proxy.IsExpired(now) {
+		return nil, &ExpiredError{
+			ProxyID:   id,
+			ExpiredAt: *proxy.ExpiresAt,
+		}
+	}
+	if proxy.NextResetAllowedAt != nil && now.Before(*proxy.NextResetAllowedAt) {
+		return nil, &CooldownError{
+			ProxyID:   id,
+			AllowedAt: *proxy.NextResetAllowedAt,
+		}
+	}
+
+	// Manager lock is not held while provider is called, rotation may
+	// take a while when it retries for a fresh exit IP
+	previousIP := proxy.EgressIP
+	if err := m.rotateUpstream(ctx, proxy); err != nil {
+		// Cancelled call says nothing about provider
+		if ctx.Err() == nil {
+			m.notifyRotationFailed(proxy, err)
+		}
+		return nil, err
+	}
+
+	// Instance which is not running picks new upstream up when it is started
+	if err := m.UpdateInstance(proxy); err != nil && !errors.Is(err, ErrInstanceNotFound) {
+		return nil, fmt.Errorf("failed to update proxy instance upstream: %w", err)
+	}
+
+	log.Printf("Proxy %d rotated manually", id)
+	m.emit(ProxyUpdated, id, proxy)
+
+	// Rotation is done, egress IP is checked even if caller went away
+	m.verifyEgress(context.WithoutCancel(ctx), proxy)
+	m.notifyRotated(proxy, previousIP)
+	return proxy, nil
+}
+
+// notifyRotated publishes rotated event. Called after egress IP of new
+// upstream was verified, so subscribers see both IPs.
+func (m *Manager) notifyRotated(proxy *models.Proxy, previousIP string) {
+	m.publish(ProxyEvent{
+		Kind:       ProxyRotated,
+		ProxyID:    proxy.ID,
+		Proxy:      proxy,
+		PreviousIP: previousIP,
+	})
+}
+
+func (m *Manager) notifyRotationFailed(proxy *models.Proxy, err error) {
+	m.publish(ProxyEvent{
+		Kind:    ProxyRotationFailed,
+		ProxyID: proxy.ID,
+		Proxy:   proxy,
+		Error:   err.Error(),
+	})
+}
+
+// rotateUpstream gets new upstream for proxy from its provider and saves
+// it, clearing reset failure state. Running instance is not touched.
+func (m *Manager) rotateUpstream(ctx context.Context, proxy *models.Proxy) error {
+	// Get service
+	service, ok := m.services.Get(proxy.ServiceType)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownService, proxy.ServiceType)
+	}
+
+	// Get new proxy
+	proxyInfo, err := service.GetNewProxy(ctx, proxy.APIKey, proxy.ProviderOptions)
+	if err != nil {
+		return fmt.Errorf("failed to get new proxy: %w", err)
+	}
+	proxyInfo = m.freshUpstream(ctx, proxy, service, proxyInfo)
+
+	// Provider cooldown counts from the upstream kept, not from the first
+	// request, freshness retries may have waited in between
+	resetTime := time.Now()
+	if _, err := selectUpstream(proxyInfo.Upstream, proxyInfo.SOCKS5, proxy.UpstreamProtocol); err != nil {
+		return err
+	}
+	upstream, err := upstreamValue(proxyInfo.Upstream)
+	if err != nil {
+		return err
+	}
+	upstreamSOCKS5, err := upstreamValue(proxyInfo.SOCKS5)
+	if err != nil {
+		return err
+	}
+
+	// Not every provider reports expiry and cooldown on rotation, refresh
+	// them from current proxy
+	if current, err := service.GetCurrentProxy(ctx, proxy.APIKey); err != nil {
+		log.Printf("Failed to refresh expiry of proxy %d: %v", proxy.ID, err)
+	} else {
+		if !current.ExpiresAt.IsZero() {
+			proxyInfo.ExpiresAt = current.ExpiresAt
+		}
+		if proxyInfo.NextResetAfter == 0 {
+			proxyInfo.NextResetAfter = current.NextResetAfter
+		}
+	}
+
+	expiresAt := expiresAtValue(proxyInfo)
+	nextResetAllowedAt := nextResetAllowedValue(proxyInfo, resetTime)
+
+	// Update database, clearing failure state of previous attempts
+	_, err = m.db.Exec(`
+		UPDATE proxies
+		SET proxy_str = ?, proxy_socks5_str = ?, upstream = ?, upstream_socks5 = ?, last_reset_at = ?, expires_at = COALESCE(?, expires_at), next_reset_allowed_at = ?,
+			last_error = '', consecutive_failures = 0, next_attempt_at = NULL, reset_disabled = 0
+		WHERE id = ?
+	`, upstreamDisplay(proxyInfo.Upstream), upstreamDisplay(proxyInfo.SOCKS5), upstream, upstreamSOCKS5, resetTime, expiresAt, nextResetAllowedAt, proxy.ID)
+
+	if err != nil {
+		return fmt.Errorf("failed to update database: %w", err)
+	}
+	proxy.Upstream = proxyInfo.Upstream
+	proxy.UpstreamSOCKS5 = proxyInfo.SOCKS5
+	proxy.ProxyStr = upstreamDisplay(proxyInfo.Upstream)
+	proxy.ProxySOCKS5Str = upstreamDisplay(proxyInfo.SOCKS5)
+	proxy.LastResetAt = resetTime
+	proxy.LastError = ""
+	proxy.ConsecutiveFailures = 0
+	proxy.NextAttemptAt = nil
+	proxy.ResetDisabled = false
+	if expiresAt != nil {
+		proxy.ExpiresAt = expiresAt
+		proxy.Expired = proxy.IsExpired(time.Now())
+	}
+	proxy.NextResetAllowedAt = nextResetAllowedAt
+	proxy.NextResetAt = plannedResetAt(proxy)
+
+	return nil
+}
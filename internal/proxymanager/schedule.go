@@ -0,0 +1,272 @@
+package proxymanager
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+var (
+	ErrInvalidSchedule     = errors.New("invalid reset_schedule")
+	ErrInvalidMinTimeReset = errors.New("min_time_reset must be at least 1 second unless reset_schedule is set")
+)
+
+// scheduleSearchYears bounds search for next firing of a schedule
+const scheduleSearchYears = 5
+
+// parsedSchedules caches schedules by spec. Schedules are parsed when
+// proxies are written, so listing and scheduling proxies doesn't parse
+// them again.
+var parsedSchedules sync.Map // spec -> *ResetSchedule, nil if invalid
+
+// scheduleDescriptors are shorthands accepted in place of five cron fields
+var scheduleDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// ResetSchedule is a calendar schedule of proxy resets in cron format:
+// "minute hour day-of-month month day-of-week", optionally prefixed with
+// "CRON_TZ=<zone> ". Fields accept *, numbers, ranges, lists and steps.
+type ResetSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// Day of month and day of week match either one unless one of them is *
+	domStar, dowStar bool
+	loc              *time.Location
+}
+
+// ParseResetSchedule parses and validates cron-like reset schedule
+func ParseResetSchedule(spec string) (*ResetSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	schedule := &ResetSchedule{loc: time.Local}
+
+	if rest, ok := strings.CutPrefix(spec, "CRON_TZ="); ok {
+		zone, fields, _ := strings.Cut(rest, " ")
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown time zone %q", ErrInvalidSchedule, zone)
+		}
+		schedule.loc = loc
+		spec = strings.TrimSpace(fields)
+	}
+
+	if expanded, ok := scheduleDescriptors[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields (minute hour day month weekday), got %d", ErrInvalidSchedule, len(fields))
+	}
+
+	var err error
+	if schedule.minute, err = parseScheduleField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("%w: minute: %v", ErrInvalidSchedule, err)
+	}
+	if schedule.hour, err = parseScheduleField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("%w: hour: %v", ErrInvalidSchedule, err)
+	}
+	if schedule.dom, err = parseScheduleField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("%w: day of month: %v", ErrInvalidSchedule, err)
+	}
+	if schedule.month, err = parseScheduleField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("%w: month: %v", ErrInvalidSchedule, err)
+	}
+	if schedule.dow, err = parseScheduleField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("%w: day of week: %v", ErrInvalidSchedule, err)
+	}
+	// Both 0 and 7 mean Sunday
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+	schedule.domStar = strings.HasPrefix(fields[2], "*")
+	schedule.dowStar = strings.HasPrefix(fields[4], "*")
+
+	if schedule.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("%w: schedule never fires", ErrInvalidSchedule)
+	}
+
+	return schedule, nil
+}
+
+// parseScheduleField parses comma separated list of *, n, a-b with
+// optional /step into bitset of allowed values
+func parseScheduleField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		var start, end int
+		switch {
+		case rangePart == "*":
+			start, end = min, max
+		case strings.Contains(rangePart, "-"):
+			startStr, endStr, _ := strings.Cut(rangePart, "-")
+			var err error
+			if start, err = strconv.Atoi(startStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", startStr)
+			}
+			if end, err = strconv.Atoi(endStr); err != nil {
+				return 0, fmt.Errorf("invalid value %q", endStr)
+			}
+		default:
+			var err error
+			if start, err = strconv.Atoi(rangePart); err != nil {
+				return 0, fmt.Errorf("invalid value %q", rangePart)
+			}
+			end = start
+			// "n/step" means from n to the end of the range
+			if hasStep {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+
+	return bits, nil
+}
+
+// Next returns first scheduled time after given time, or zero time if
+// schedule doesn't fire within next few years. Times skipped when clocks
+// go forward don't fire, times repeated when clocks go back fire once.
+func (s *ResetSchedule) Next(after time.Time) time.Time {
+	t := after.In(s.loc)
+	afterWall := wallClock(t)
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, s.loc).Add(time.Minute)
+	yearLimit := t.Year() + scheduleSearchYears
+
+	for t.Year() <= yearLimit {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = advance(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, s.loc))
+		case !s.dayMatches(t):
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, s.loc))
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = advance(t, time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, s.loc))
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		case !wallClock(t).After(afterWall):
+			// Hour repeated after clocks went back already fired
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// advance moves t to next. Wall clock time skipped when clocks go forward
+// is normalized to an earlier time, t moves to the next hour then instead.
+func advance(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Hour - time.Duration(t.Minute())*time.Minute)
+}
+
+// wallClock returns local date and time of t to the minute, without zone
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func (s *ResetSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// dueAt returns when proxy reset last at lastResetAt is due: next firing
+// of schedule if it has one, min_time_reset after last reset otherwise
+func dueAt(schedule *ResetSchedule, lastResetAt time.Time, minTimeReset time.Duration) time.Time {
+	if schedule != nil {
+		if next := schedule.Next(lastResetAt); !next.IsZero() {
+			return next
+		}
+	}
+	return lastResetAt.Add(minTimeReset)
+}
+
+// validateResetTiming checks proxy has either reset schedule or positive
+// min_time_reset, and caches parsed schedule
+func validateResetTiming(spec string, minTimeReset int) error {
+	if spec == "" {
+		if minTimeReset < 1 {
+			return ErrInvalidMinTimeReset
+		}
+		return nil
+	}
+	if minTimeReset < 0 {
+		return ErrInvalidMinTimeReset
+	}
+
+	schedule, err := ParseResetSchedule(spec)
+	if err != nil {
+		return err
+	}
+	parsedSchedules.Store(spec, schedule)
+	return nil
+}
+
+// proxySchedule returns parsed reset schedule of proxy, nil if it resets
+// by min_time_reset
+func proxySchedule(proxy *models.Proxy) *ResetSchedule {
+	if proxy.ResetSchedule == "" {
+		return nil
+	}
+	if cached, ok := parsedSchedules.Load(proxy.ResetSchedule); ok {
+		return cached.(*ResetSchedule)
+	}
+
+	// Schedule stored by previous run is parsed once
+	schedule, err := ParseResetSchedule(proxy.ResetSchedule)
+	if err != nil {
+		// Stored schedules are validated, keep proxy rotating by interval
+		schedule = nil
+	}
+	parsedSchedules.Store(proxy.ResetSchedule, schedule)
+	return schedule
+}
+
+// plannedResetAt returns when auto-reset plans to rotate proxy, before
+// jitter is added, or nil if proxy is not rotated automatically
+func plannedResetAt(proxy *models.Proxy) *time.Time {
+	if proxy.Status != StatusActive || proxy.ResetDisabled || proxy.Expired {
+		return nil
+	}
+
+	at := dueAt(proxySchedule(proxy), proxy.LastResetAt, time.Duration(proxy.MinTimeReset)*time.Second)
+	if proxy.NextAttemptAt != nil && at.Before(*proxy.NextAttemptAt) {
+		at = *proxy.NextAttemptAt
+	}
+	if proxy.NextResetAllowedAt != nil && at.Before(*proxy.NextResetAllowedAt) {
+		at = *proxy.NextResetAllowedAt
+	}
+	return &at
+}
@@ -0,0 +1,299 @@
+package proxymanager
+
+import (
+	"errors"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return loc
+}
+
+func TestResetScheduleNext(t *testing.T) {
+	utc := time.UTC
+	hcm := mustLocation(t, "Asia/Ho_Chi_Minh")
+
+	cases := []struct {
+		name  string
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			name:  "minute step",
+			spec:  "CRON_TZ=UTC */15 * * * *",
+			after: time.Date(2026, 1, 1, 10, 7, 0, 0, utc),
+			want:  time.Date(2026, 1, 1, 10, 15, 0, 0, utc),
+		},
+		{
+			name:  "exact firing time is excluded",
+			spec:  "CRON_TZ=UTC */15 * * * *",
+			after: time.Date(2026, 1, 1, 10, 15, 0, 0, utc),
+			want:  time.Date(2026, 1, 1, 10, 30, 0, 0, utc),
+		},
+		{
+			name:  "seconds are truncated",
+			spec:  "CRON_TZ=UTC */15 * * * *",
+			after: time.Date(2026, 1, 1, 10, 14, 59, 999, utc),
+			want:  time.Date(2026, 1, 1, 10, 15, 0, 0, utc),
+		},
+		{
+			name:  "hour step",
+			spec:  "CRON_TZ=UTC 0 */6 * * *",
+			after: time.Date(2026, 1, 1, 10, 7, 0, 0, utc),
+			want:  time.Date(2026, 1, 1, 12, 0, 0, 0, utc),
+		},
+		{
+			name:  "range with step",
+			spec:  "CRON_TZ=UTC 0 9-17/4 * * *",
+			after: time.Date(2026, 1, 1, 13, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 1, 17, 0, 0, 0, utc),
+		},
+		{
+			name:  "range with step wraps to next day",
+			spec:  "CRON_TZ=UTC 0 9-17/4 * * *",
+			after: time.Date(2026, 1, 1, 17, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 2, 9, 0, 0, 0, utc),
+		},
+		{
+			name:  "value with step runs to end of range",
+			spec:  "CRON_TZ=UTC 10/20 * * * *",
+			after: time.Date(2026, 1, 1, 10, 31, 0, 0, utc),
+			want:  time.Date(2026, 1, 1, 10, 50, 0, 0, utc),
+		},
+		{
+			name:  "list",
+			spec:  "CRON_TZ=UTC 0 0 1,15 * *",
+			after: time.Date(2026, 1, 2, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 15, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "weekday range skips weekend",
+			spec:  "CRON_TZ=UTC 30 8 * * 1-5",
+			after: time.Date(2026, 1, 2, 9, 0, 0, 0, utc), // Friday
+			want:  time.Date(2026, 1, 5, 8, 30, 0, 0, utc),
+		},
+		{
+			name:  "day of month or day of week, weekday first",
+			spec:  "CRON_TZ=UTC 0 0 13 * 5",
+			after: time.Date(2026, 1, 3, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 9, 0, 0, 0, 0, utc), // Friday
+		},
+		{
+			name:  "day of month or day of week, day of month first",
+			spec:  "CRON_TZ=UTC 0 0 13 * 5",
+			after: time.Date(2026, 1, 9, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 13, 0, 0, 0, 0, utc), // Tuesday
+		},
+		{
+			name:  "day of week star restricts by day of month only",
+			spec:  "CRON_TZ=UTC 0 0 13 * *",
+			after: time.Date(2026, 1, 3, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 13, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "day of month star restricts by day of week only",
+			spec:  "CRON_TZ=UTC 0 0 * * 5",
+			after: time.Date(2026, 1, 10, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 16, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "7 is Sunday",
+			spec:  "CRON_TZ=UTC 0 0 * * 7",
+			after: time.Date(2026, 1, 1, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 4, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "0 is Sunday",
+			spec:  "CRON_TZ=UTC 0 0 * * 0",
+			after: time.Date(2026, 1, 1, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 4, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "range ending in 7 includes Sunday",
+			spec:  "CRON_TZ=UTC 0 0 * * 6-7",
+			after: time.Date(2026, 1, 3, 12, 0, 0, 0, utc), // Saturday
+			want:  time.Date(2026, 1, 4, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "descriptor",
+			spec:  "CRON_TZ=UTC @monthly",
+			after: time.Date(2026, 1, 15, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 2, 1, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "months without the day are skipped",
+			spec:  "CRON_TZ=UTC 0 0 31 * *",
+			after: time.Date(2026, 1, 31, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 3, 31, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "leap day",
+			spec:  "CRON_TZ=UTC 0 0 29 2 *",
+			after: time.Date(2026, 3, 1, 0, 0, 0, 0, utc),
+			want:  time.Date(2028, 2, 29, 0, 0, 0, 0, utc),
+		},
+		{
+			name:  "time zone",
+			spec:  "CRON_TZ=Asia/Ho_Chi_Minh 0 0 * * *",
+			after: time.Date(2026, 1, 1, 0, 0, 0, 0, utc),
+			want:  time.Date(2026, 1, 2, 0, 0, 0, 0, hcm),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := ParseResetSchedule(tc.spec)
+			if err != nil {
+				t.Fatalf("ParseResetSchedule(%q): %v", tc.spec, err)
+			}
+			if got := schedule.Next(tc.after); !got.Equal(tc.want) {
+				t.Errorf("Next(%v) = %v, want %v", tc.after, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResetScheduleNextDST(t *testing.T) {
+	ny := mustLocation(t, "America/New_York")
+	havana := mustLocation(t, "America/Havana")
+
+	cases := []struct {
+		name  string
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{
+			// 2026-03-08 02:00 EST jumps to 03:00 EDT
+			name:  "time skipped by spring forward doesn't fire",
+			spec:  "CRON_TZ=America/New_York 30 2 * * *",
+			after: time.Date(2026, 3, 7, 3, 0, 0, 0, ny),
+			want:  time.Date(2026, 3, 9, 2, 30, 0, 0, ny),
+		},
+		{
+			name:  "hourly across spring forward",
+			spec:  "CRON_TZ=America/New_York 0 * * * *",
+			after: time.Date(2026, 3, 8, 1, 30, 0, 0, ny),
+			want:  time.Date(2026, 3, 8, 3, 0, 0, 0, ny),
+		},
+		{
+			// 2026-03-08 00:00 CST jumps to 01:00 CDT, midnight doesn't exist
+			name:  "midnight skipped by spring forward doesn't fire",
+			spec:  "CRON_TZ=America/Havana 0 0 * * *",
+			after: time.Date(2026, 3, 7, 12, 0, 0, 0, havana),
+			want:  time.Date(2026, 3, 9, 0, 0, 0, 0, havana),
+		},
+		{
+			name:  "hourly across midnight spring forward",
+			spec:  "CRON_TZ=America/Havana 0 * * * *",
+			after: time.Date(2026, 3, 7, 23, 0, 0, 0, havana),
+			want:  time.Date(2026, 3, 8, 1, 0, 0, 0, havana),
+		},
+		{
+			// 2026-11-01 02:00 EDT goes back to 01:00 EST
+			name:  "repeated time fires on first occurrence",
+			spec:  "CRON_TZ=America/New_York 30 1 * * *",
+			after: time.Date(2026, 11, 1, 0, 0, 0, 0, ny),
+			want:  time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), // 01:30 EDT
+		},
+		{
+			name:  "repeated time doesn't fire twice",
+			spec:  "CRON_TZ=America/New_York 30 1 * * *",
+			after: time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), // 01:30 EDT
+			want:  time.Date(2026, 11, 2, 1, 30, 0, 0, ny),
+		},
+		{
+			name:  "hourly across fall back",
+			spec:  "CRON_TZ=America/New_York 0 * * * *",
+			after: time.Date(2026, 11, 1, 5, 0, 0, 0, time.UTC), // 01:00 EDT
+			want:  time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC), // 02:00 EST
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := ParseResetSchedule(tc.spec)
+			if err != nil {
+				t.Fatalf("ParseResetSchedule(%q): %v", tc.spec, err)
+			}
+			if got := schedule.Next(tc.after); !got.Equal(tc.want) {
+				t.Errorf("Next(%v) = %v, want %v", tc.after, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseResetScheduleInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		spec string
+	}{
+		{"empty", ""},
+		{"too few fields", "0 0 * *"},
+		{"too many fields", "0 0 * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "0 24 * * *"},
+		{"day of month zero", "0 0 0 * *"},
+		{"month out of range", "0 0 1 13 *"},
+		{"day of week out of range", "0 0 * * 8"},
+		{"reversed range", "5-1 * * * *"},
+		{"zero step", "*/0 * * * *"},
+		{"bad value", "x * * * *"},
+		{"unknown descriptor", "@yearly"},
+		{"unknown time zone", "CRON_TZ=Mars/Olympus 0 0 * * *"},
+		{"never fires, February 30", "0 0 30 2 *"},
+		{"never fires, April 31", "0 0 31 4 *"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseResetSchedule(tc.spec)
+			if !errors.Is(err, ErrInvalidSchedule) {
+				t.Errorf("ParseResetSchedule(%q) error = %v, want ErrInvalidSchedule", tc.spec, err)
+			}
+		})
+	}
+}
+
+func TestParseResetScheduleDefaultsToLocal(t *testing.T) {
+	schedule, err := ParseResetSchedule("0 0 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if schedule.loc != time.Local {
+		t.Errorf("loc = %v, want Local", schedule.loc)
+	}
+}
+
+func TestValidateResetTiming(t *testing.T) {
+	cases := []struct {
+		name         string
+		spec         string
+		minTimeReset int
+		wantErr      error
+	}{
+		{"interval only", "", 60, nil},
+		{"interval missing", "", 0, ErrInvalidMinTimeReset},
+		{"schedule without interval", "0 0 * * *", 0, nil},
+		{"schedule with interval", "0 0 * * *", 60, nil},
+		{"negative interval with schedule", "0 0 * * *", -1, ErrInvalidMinTimeReset},
+		{"invalid schedule", "0 0 30 2 *", 0, ErrInvalidSchedule},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateResetTiming(tc.spec, tc.minTimeReset)
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("validateResetTiming(%q, %d) = %v, want %v", tc.spec, tc.minTimeReset, err, tc.wantErr)
+			}
+		})
+	}
+}
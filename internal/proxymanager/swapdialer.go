@@ -0,0 +1,224 @@
+package proxymanager
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-forward-proxy/pkg/dumbproxy/dialer"
+	clog "go-forward-proxy/pkg/dumbproxy/log"
+)
+
+// upstreamGeneration is one upstream dialer together with the connections
+// that were dialed through it
+type upstreamGeneration struct {
+	dialer  dialer.Dialer
+	mu      sync.Mutex
+	conns   map[*trackedConn]struct{}
+	retired bool
+	onEmpty func()
+}
+
+func newUpstreamGeneration(d dialer.Dialer) *upstreamGeneration {
+	return &upstreamGeneration{
+		dialer: d,
+		conns:  make(map[*trackedConn]struct{}),
+	}
+}
+
+// add tracks connection dialed through generation. Returns false if
+// generation was retired meanwhile, its drain may already be over.
+func (g *upstreamGeneration) add(c *trackedConn) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.conns[c] = struct{}{}
+	return true
+}
+
+func (g *upstreamGeneration) remove(c *trackedConn) {
+	g.mu.Lock()
+	delete(g.conns, c)
+	empty := g.retired && len(g.conns) == 0
+	onEmpty := g.onEmpty
+	g.mu.Unlock()
+
+	if empty && onEmpty != nil {
+		onEmpty()
+	}
+}
+
+func (g *upstreamGeneration) count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.conns)
+}
+
+// retire marks generation as replaced. onEmpty is called once the last
+// connection is closed. Returns false if generation has no connections left.
+func (g *upstreamGeneration) retire(onEmpty func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = true
+	g.onEmpty = onEmpty
+	return len(g.conns) > 0
+}
+
+// closeAll force-closes all connections still open and returns their number
+func (g *upstreamGeneration) closeAll() int {
+	g.mu.Lock()
+	conns := make([]*trackedConn, 0, len(g.conns))
+	for c := range g.conns {
+		conns = append(conns, c)
+	}
+	g.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+	return len(conns)
+}
+
+// trackedConn removes itself from its generation when closed
+type trackedConn struct {
+	net.Conn
+	gen       *upstreamGeneration
+	closeOnce sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		c.gen.remove(c)
+	})
+	return err
+}
+
+// CloseWrite preserves half-close semantics of the underlying connection
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// swapDialer is an upstream dialer which can be replaced atomically while
+// the proxy is serving. New dials always go to the current upstream, while
+// connections made through a replaced upstream keep running until they finish
+// or the drain timeout passes.
+type swapDialer struct {
+	current      atomic.Pointer[upstreamGeneration]
+	drainTimeout time.Duration
+	logger       *clog.CondLogger
+	// onDialError is called for every failed dial through upstream
+	onDialError func(err error)
+
+	mu       sync.Mutex
+	draining map[*upstreamGeneration]*time.Timer
+}
+
+func newSwapDialer(d dialer.Dialer, drainTimeout time.Duration, logger *clog.CondLogger) *swapDialer {
+	sd := &swapDialer{
+		drainTimeout: drainTimeout,
+		logger:       logger,
+		draining:     make(map[*upstreamGeneration]*time.Timer),
+	}
+	sd.current.Store(newUpstreamGeneration(d))
+	return sd
+}
+
+func (sd *swapDialer) Dial(network, address string) (net.Conn, error) {
+	return sd.DialContext(context.Background(), network, address)
+}
+
+func (sd *swapDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	for {
+		gen := sd.current.Load()
+		conn, err := gen.dialer.DialContext(ctx, network, address)
+		if err != nil {
+			if sd.onDialError != nil {
+				sd.onDialError(err)
+			}
+			return nil, err
+		}
+
+		tc := &trackedConn{
+			Conn: conn,
+			gen:  gen,
+		}
+		if gen.add(tc) {
+			return tc, nil
+		}
+
+		// Upstream was swapped while dialing, connection would escape drain
+		// timeout of the previous upstream. Dial again through the new one.
+		conn.Close()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Swap replaces upstream dialer. Connections of the previous upstream are
+// left to drain in background.
+func (sd *swapDialer) Swap(d dialer.Dialer) {
+	old := sd.current.Swap(newUpstreamGeneration(d))
+	if old == nil {
+		return
+	}
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if !old.retire(func() { sd.finishDrain(old) }) {
+		return
+	}
+
+	sd.draining[old] = time.AfterFunc(sd.drainTimeout, func() {
+		if n := old.closeAll(); n > 0 {
+			sd.logger.Warning("Drain timeout reached, closed %d connection(s) on previous upstream", n)
+		}
+		sd.finishDrain(old)
+	})
+}
+
+func (sd *swapDialer) finishDrain(gen *upstreamGeneration) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if timer, ok := sd.draining[gen]; ok {
+		timer.Stop()
+		delete(sd.draining, gen)
+	}
+}
+
+// Upstream returns current upstream dialer without connection tracking
+func (sd *swapDialer) Upstream() dialer.Dialer {
+	return sd.current.Load().dialer
+}
+
+// ActiveConns returns number of connections open through current upstream
+func (sd *swapDialer) ActiveConns() int {
+	return sd.current.Load().count()
+}
+
+// DrainingConns returns number of connections still open through
+// replaced upstreams
+func (sd *swapDialer) DrainingConns() int {
+	sd.mu.Lock()
+	gens := make([]*upstreamGeneration, 0, len(sd.draining))
+	for gen := range sd.draining {
+		gens = append(gens, gen)
+	}
+	sd.mu.Unlock()
+
+	total := 0
+	for _, gen := range gens {
+		total += gen.count()
+	}
+	return total
+}
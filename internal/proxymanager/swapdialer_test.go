@@ -0,0 +1,223 @@
+package proxymanager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	clog "go-forward-proxy/pkg/dumbproxy/log"
+)
+
+// fakeDialer hands out in-memory connections labelled with its name
+type fakeDialer struct {
+	name string
+	err  error
+	// onDial runs inside every dial, before connection is returned
+	onDial func()
+
+	mu    sync.Mutex
+	peers []net.Conn // Upstream ends of dialed connections
+}
+
+type namedConn struct {
+	net.Conn
+	upstream string
+}
+
+func (d *fakeDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *fakeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.onDial != nil {
+		d.onDial()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	conn, peer := net.Pipe()
+	d.mu.Lock()
+	d.peers = append(d.peers, peer)
+	d.mu.Unlock()
+	return &namedConn{Conn: conn, upstream: d.name}, nil
+}
+
+func (d *fakeDialer) peer(t *testing.T, i int) net.Conn {
+	t.Helper()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if i >= len(d.peers) {
+		t.Fatalf("upstream %s has %d connection(s), want at least %d", d.name, len(d.peers), i+1)
+	}
+	return d.peers[i]
+}
+
+// waitClosed fails test unless connection of peer gets closed soon
+func waitClosed(t *testing.T, peer net.Conn) {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from closed connection = %v, want EOF", err)
+	}
+}
+
+func newTestSwapDialer(d *fakeDialer, drainTimeout time.Duration) *swapDialer {
+	logger := clog.NewCondLogger(log.New(io.Discard, "", 0), clog.INFO)
+	return newSwapDialer(d, drainTimeout, logger)
+}
+
+func upstreamOf(t *testing.T, conn net.Conn) string {
+	t.Helper()
+	tc, ok := conn.(*trackedConn)
+	if !ok {
+		t.Fatalf("connection is %T, want *trackedConn", conn)
+	}
+	return tc.Conn.(*namedConn).upstream
+}
+
+func TestSwapDialerDial(t *testing.T) {
+	dialErr := errors.New("upstream down")
+
+	cases := []struct {
+		name string
+		// setup returns dialer under test and upstream new dial must use
+		setup        func(t *testing.T) (*swapDialer, *fakeDialer)
+		wantErr      error
+		wantDraining int
+	}{
+		{
+			name: "current upstream",
+			setup: func(t *testing.T) (*swapDialer, *fakeDialer) {
+				current := &fakeDialer{name: "current"}
+				return newTestSwapDialer(current, time.Minute), current
+			},
+		},
+		{
+			name: "swapped upstream",
+			setup: func(t *testing.T) (*swapDialer, *fakeDialer) {
+				sd := newTestSwapDialer(&fakeDialer{name: "old"}, time.Minute)
+				next := &fakeDialer{name: "new"}
+				sd.Swap(next)
+				return sd, next
+			},
+		},
+		{
+			name: "swap during in-flight dial",
+			setup: func(t *testing.T) (*swapDialer, *fakeDialer) {
+				old := &fakeDialer{name: "old"}
+				next := &fakeDialer{name: "new"}
+				sd := newTestSwapDialer(old, time.Minute)
+				var once sync.Once
+				old.onDial = func() {
+					once.Do(func() { sd.Swap(next) })
+				}
+				t.Cleanup(func() {
+					// Connection dialed through retired upstream is closed
+					waitClosed(t, old.peer(t, 0))
+				})
+				return sd, next
+			},
+		},
+		{
+			name: "failed dial",
+			setup: func(t *testing.T) (*swapDialer, *fakeDialer) {
+				current := &fakeDialer{name: "current", err: dialErr}
+				return newTestSwapDialer(current, time.Minute), current
+			},
+			wantErr: dialErr,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			sd, want := tc.setup(t)
+			var reported error
+			sd.onDialError = func(err error) { reported = err }
+
+			conn, err := sd.DialContext(context.Background(), "tcp", "example.com:443")
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) || !errors.Is(reported, tc.wantErr) {
+					t.Errorf("DialContext error = %v, reported %v, want %v", err, reported, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("DialContext: %v", err)
+			}
+			defer conn.Close()
+
+			if got := upstreamOf(t, conn); got != want.name {
+				t.Errorf("dialed through %q, want %q", got, want.name)
+			}
+			if got := sd.ActiveConns(); got != 1 {
+				t.Errorf("ActiveConns() = %d, want 1", got)
+			}
+			if got := sd.DrainingConns(); got != tc.wantDraining {
+				t.Errorf("DrainingConns() = %d, want %d", got, tc.wantDraining)
+			}
+		})
+	}
+}
+
+func TestSwapDialerDrain(t *testing.T) {
+	old := &fakeDialer{name: "old"}
+	sd := newTestSwapDialer(old, time.Minute)
+
+	conn, err := sd.Dial("tcp", "example.com:443")
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+
+	sd.Swap(&fakeDialer{name: "new"})
+	if got := sd.DrainingConns(); got != 1 {
+		t.Fatalf("DrainingConns() after swap = %d, want 1", got)
+	}
+	if got := sd.ActiveConns(); got != 0 {
+		t.Errorf("ActiveConns() after swap = %d, want 0", got)
+	}
+
+	// Tunnel of previous upstream keeps working until it is closed
+	go conn.Write([]byte("x"))
+	buf := make([]byte, 1)
+	if _, err := old.peer(t, 0).Read(buf); err != nil {
+		t.Fatalf("read from draining connection: %v", err)
+	}
+
+	conn.Close()
+	if got := sd.DrainingConns(); got != 0 {
+		t.Errorf("DrainingConns() after close = %d, want 0", got)
+	}
+	sd.mu.Lock()
+	left := len(sd.draining)
+	sd.mu.Unlock()
+	if left != 0 {
+		t.Errorf("%d upstream(s) still draining after last connection closed", left)
+	}
+}
+
+func TestSwapDialerDrainTimeout(t *testing.T) {
+	old := &fakeDialer{name: "old"}
+	sd := newTestSwapDialer(old, 10*time.Millisecond)
+
+	if _, err := sd.Dial("tcp", "example.com:443"); err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	sd.Swap(&fakeDialer{name: "new"})
+
+	// Connection outliving drain timeout is cut
+	waitClosed(t, old.peer(t, 0))
+
+	deadline := time.Now().Add(time.Second)
+	for sd.DrainingConns() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("DrainingConns() = %d after drain timeout, want 0", sd.DrainingConns())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
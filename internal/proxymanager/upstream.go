@@ -0,0 +1,65 @@
+package proxymanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+// Protocols instances use to reach provider endpoint
+const (
+	UpstreamHTTP   = "http"
+	UpstreamSOCKS5 = "socks5"
+)
+
+var (
+	ErrInvalidUpstreamProtocol = errors.New("upstream_protocol must be 'http' or 'socks5'")
+	ErrNoSOCKS5Endpoint        = errors.New("provider returned no SOCKS5 endpoint")
+	ErrNoUpstream              = errors.New("proxy has no upstream")
+)
+
+// ValidUpstreamProtocol reports whether protocol is a known upstream protocol
+func ValidUpstreamProtocol(protocol string) bool {
+	return protocol == UpstreamHTTP || protocol == UpstreamSOCKS5
+}
+
+// selectUpstream returns provider endpoint selected by protocol
+func selectUpstream(httpUpstream, socks5 *models.Upstream, protocol string) (*models.Upstream, error) {
+	if protocol == UpstreamSOCKS5 {
+		if socks5 == nil {
+			return nil, ErrNoSOCKS5Endpoint
+		}
+		return socks5, nil
+	}
+	if httpUpstream == nil {
+		return nil, ErrNoUpstream
+	}
+	return httpUpstream, nil
+}
+
+// proxyUpstream returns provider endpoint proxy is using
+func proxyUpstream(proxy *models.Proxy) (*models.Upstream, error) {
+	return selectUpstream(proxy.Upstream, proxy.UpstreamSOCKS5, proxy.UpstreamProtocol)
+}
+
+// upstreamValue returns upstream for storing, empty string if there is none
+func upstreamValue(upstream *models.Upstream) (string, error) {
+	if upstream == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(upstream)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal upstream: %w", err)
+	}
+	return string(data), nil
+}
+
+// upstreamDisplay returns display form of upstream, empty if there is none
+func upstreamDisplay(upstream *models.Upstream) string {
+	if upstream == nil {
+		return ""
+	}
+	return upstream.String()
+}
@@ -0,0 +1,340 @@
+package proxymanager
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-forward-proxy/pkg/dumbproxy/handler"
+)
+
+// Usage series granularities
+const (
+	GranularityHour = "hour"
+	GranularityDay  = "day"
+)
+
+// UsageBytes is traffic transferred through a proxy
+type UsageBytes struct {
+	BytesUp   int64 `json:"bytes_up"`   // Client to destination
+	BytesDown int64 `json:"bytes_down"` // Destination to client
+}
+
+func (b *UsageBytes) add(other UsageBytes) {
+	b.BytesUp += other.BytesUp
+	b.BytesDown += other.BytesDown
+}
+
+// UsagePoint is traffic of one series bucket
+type UsagePoint struct {
+	Time time.Time `json:"time"`
+	UsageBytes
+}
+
+// UsageReport is traffic of a proxy over time range
+type UsageReport struct {
+	ProxyID     uint                  `json:"proxy_id"`
+	From        time.Time             `json:"from"`
+	To          time.Time             `json:"to"`
+	Granularity string                `json:"granularity"`
+	Total       UsageBytes            `json:"total"`
+	ByUsername  map[string]UsageBytes `json:"by_username"`
+	Series      []UsagePoint          `json:"series"`
+}
+
+type usageKey struct {
+	proxyID  uint
+	username string
+	hour     time.Time
+}
+
+// usageCounter counts traffic of one forwarded connection
+type usageCounter struct {
+	// proxyID resolves proxy the traffic belongs to. It is resolved lazily
+	// because gateway picks upstream only after forwarding has started.
+	// Zero means not known yet.
+	proxyID  func() uint
+	username string
+	up       atomic.Int64
+	down     atomic.Int64
+}
+
+// UsageRecorder counts traffic of forwarded connections per proxy and
+// username and periodically flushes it into hourly rollups in database
+type UsageRecorder struct {
+	db            *sql.DB
+	flushInterval time.Duration
+	retention     time.Duration
+
+	mu      sync.Mutex
+	active  map[*usageCounter]struct{}
+	pending map[usageKey]*UsageBytes
+}
+
+func NewUsageRecorder(db *sql.DB, flushInterval, retentionDays int) *UsageRecorder {
+	return &UsageRecorder{
+		db:            db,
+		flushInterval: time.Duration(flushInterval) * time.Second,
+		retention:     time.Duration(retentionDays) * 24 * time.Hour,
+		active:        make(map[*usageCounter]struct{}),
+		pending:       make(map[usageKey]*UsageBytes),
+	}
+}
+
+// wrap returns forward function which counts traffic of every forwarded
+// connection towards proxy returned by proxyID
+func (ur *UsageRecorder) wrap(proxyID func(ctx context.Context) uint, next handler.ForwardFunc) handler.ForwardFunc {
+	return func(ctx context.Context, username string, incoming, outgoing io.ReadWriteCloser, network, address string) error {
+		counter := &usageCounter{
+			proxyID:  func() uint { return proxyID(ctx) },
+			username: username,
+		}
+
+		ur.mu.Lock()
+		ur.active[counter] = struct{}{}
+		ur.mu.Unlock()
+
+		defer func() {
+			ur.mu.Lock()
+			delete(ur.active, counter)
+			ur.collect(counter, time.Now())
+			ur.mu.Unlock()
+		}()
+
+		return next(
+			ctx,
+			username,
+			&countingStream{ReadWriteCloser: incoming, read: &counter.up},
+			&countingStream{ReadWriteCloser: outgoing, read: &counter.down},
+			network,
+			address,
+		)
+	}
+}
+
+// collect moves bytes counted so far into pending rollup of current hour.
+// Caller must hold ur.mu.
+func (ur *UsageRecorder) collect(counter *usageCounter, now time.Time) {
+	id := counter.proxyID()
+	if id == 0 {
+		return
+	}
+
+	delta := UsageBytes{
+		BytesUp:   counter.up.Swap(0),
+		BytesDown: counter.down.Swap(0),
+	}
+	if delta.BytesUp == 0 && delta.BytesDown == 0 {
+		return
+	}
+
+	key := usageKey{
+		proxyID:  id,
+		username: counter.username,
+		hour:     now.UTC().Truncate(time.Hour),
+	}
+	if ur.pending[key] == nil {
+		ur.pending[key] = &UsageBytes{}
+	}
+	ur.pending[key].add(delta)
+}
+
+func (ur *UsageRecorder) Start(ctx context.Context) {
+	if ur.flushInterval <= 0 {
+		log.Println("UsageRecorder flushing disabled")
+		return
+	}
+
+	ticker := time.NewTicker(ur.flushInterval)
+	defer ticker.Stop()
+
+	log.Printf("UsageRecorder started with flush interval: %v, retention: %v", ur.flushInterval, ur.retention)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("UsageRecorder stopped")
+			return
+		case <-ticker.C:
+			if err := ur.Flush(); err != nil {
+				log.Printf("Failed to flush traffic usage: %v", err)
+			}
+			if err := ur.prune(); err != nil {
+				log.Printf("Failed to prune traffic usage: %v", err)
+			}
+		}
+	}
+}
+
+// Flush writes traffic counted so far into database. Counts which could
+// not be written are kept for the next flush.
+func (ur *UsageRecorder) Flush() error {
+	now := time.Now()
+
+	ur.mu.Lock()
+	for counter := range ur.active {
+		ur.collect(counter, now)
+	}
+	pending := ur.pending
+	ur.pending = make(map[usageKey]*UsageBytes)
+	ur.mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	if err := ur.write(pending); err != nil {
+		ur.mu.Lock()
+		for key, bytes := range pending {
+			if ur.pending[key] == nil {
+				ur.pending[key] = &UsageBytes{}
+			}
+			ur.pending[key].add(*bytes)
+		}
+		ur.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (ur *UsageRecorder) write(pending map[usageKey]*UsageBytes) error {
+	tx, err := ur.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Traffic of tunnels still draining after proxy was deleted is dropped
+	for key, bytes := range pending {
+		_, err := tx.Exec(`
+			INSERT INTO proxy_usage (proxy_id, username, hour, bytes_up, bytes_down)
+			SELECT ?, ?, ?, ?, ?
+			WHERE EXISTS (SELECT 1 FROM proxies WHERE id = ?)
+			ON CONFLICT (proxy_id, username, hour) DO UPDATE SET
+				bytes_up = bytes_up + excluded.bytes_up,
+				bytes_down = bytes_down + excluded.bytes_down
+		`, key.proxyID, key.username, key.hour, bytes.BytesUp, bytes.BytesDown, key.proxyID)
+		if err != nil {
+			return fmt.Errorf("failed to save usage of proxy %d: %w", key.proxyID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit usage: %w", err)
+	}
+	return nil
+}
+
+// prune deletes rollups older than retention period
+func (ur *UsageRecorder) prune() error {
+	if ur.retention <= 0 {
+		return nil
+	}
+
+	cutoff := time.Now().UTC().Add(-ur.retention).Truncate(time.Hour)
+	if _, err := ur.db.Exec("DELETE FROM proxy_usage WHERE hour < ?", cutoff); err != nil {
+		return fmt.Errorf("failed to delete old usage: %w", err)
+	}
+	return nil
+}
+
+// Report returns traffic of proxy within [from, to) bucketed by granularity
+func (ur *UsageRecorder) Report(proxyID uint, from, to time.Time, granularity string) (*UsageReport, error) {
+	bucket := time.Hour
+	switch granularity {
+	case GranularityHour:
+	case GranularityDay:
+		bucket = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("unknown granularity: %s", granularity)
+	}
+
+	rows, err := ur.db.Query(`
+		SELECT username, hour, bytes_up, bytes_down
+		FROM proxy_usage
+		WHERE proxy_id = ? AND hour >= ? AND hour < ?
+	`, proxyID, from.UTC().Truncate(time.Hour), to.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage: %w", err)
+	}
+	defer rows.Close()
+
+	report := &UsageReport{
+		ProxyID:     proxyID,
+		From:        from,
+		To:          to,
+		Granularity: granularity,
+		ByUsername:  make(map[string]UsageBytes),
+		Series:      []UsagePoint{},
+	}
+	buckets := make(map[time.Time]*UsagePoint)
+
+	for rows.Next() {
+		var (
+			username string
+			hour     time.Time
+			bytes    UsageBytes
+		)
+		if err := rows.Scan(&username, &hour, &bytes.BytesUp, &bytes.BytesDown); err != nil {
+			return nil, fmt.Errorf("failed to scan usage: %w", err)
+		}
+
+		report.Total.add(bytes)
+
+		byUser := report.ByUsername[username]
+		byUser.add(bytes)
+		report.ByUsername[username] = byUser
+
+		start := hour.UTC().Truncate(bucket)
+		if buckets[start] == nil {
+			buckets[start] = &UsagePoint{Time: start}
+		}
+		buckets[start].add(bytes)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage: %w", err)
+	}
+
+	for _, point := range buckets {
+		report.Series = append(report.Series, *point)
+	}
+	sort.Slice(report.Series, func(i, j int) bool {
+		return report.Series[i].Time.Before(report.Series[j].Time)
+	})
+
+	return report, nil
+}
+
+// Totals returns stored traffic of every proxy
+func (ur *UsageRecorder) Totals() (map[uint]UsageBytes, error) {
+	rows, err := ur.db.Query(`
+		SELECT proxy_id, SUM(bytes_up), SUM(bytes_down)
+		FROM proxy_usage
+		GROUP BY proxy_id
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query usage totals: %w", err)
+	}
+	defer rows.Close()
+
+	totals := make(map[uint]UsageBytes)
+	for rows.Next() {
+		var (
+			id    uint
+			bytes UsageBytes
+		)
+		if err := rows.Scan(&id, &bytes.BytesUp, &bytes.BytesDown); err != nil {
+			return nil, fmt.Errorf("failed to scan usage totals: %w", err)
+		}
+		totals[id] = bytes
+	}
+
+	return totals, rows.Err()
+}
@@ -0,0 +1,595 @@
+package proxymanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-forward-proxy/internal/config"
+	"go-forward-proxy/internal/database/models"
+)
+
+// Webhook events, named after proxy event kinds they are sent for
+const (
+	WebhookProxyCreated        = "proxy.created"
+	WebhookProxyRotated        = "proxy.rotated"
+	WebhookProxyRotationFailed = "proxy.rotation_failed"
+	WebhookProxyExpired        = "proxy.expired"
+	WebhookProxyHealthDegraded = "proxy.health_degraded"
+	WebhookProxyDeleted        = "proxy.deleted"
+)
+
+// WebhookEvents lists events webhooks can subscribe to
+var WebhookEvents = []string{
+	WebhookProxyCreated,
+	WebhookProxyRotated,
+	WebhookProxyRotationFailed,
+	WebhookProxyExpired,
+	WebhookProxyHealthDegraded,
+	WebhookProxyDeleted,
+}
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed" // Gave up after max attempts
+)
+
+// Headers of webhook requests
+const (
+	WebhookEventHeader     = "X-Webhook-Event"
+	WebhookDeliveryHeader  = "X-Webhook-Delivery"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	// webhookPollInterval is how often outbox is checked for due retries
+	webhookPollInterval = 5 * time.Second
+	// webhookRetryInterval is delay after first failed delivery, doubled
+	// after each next failure
+	webhookRetryInterval = 10 * time.Second
+	// webhookBatchSize limits deliveries sent in parallel
+	webhookBatchSize = 20
+	// webhookSecretLength is length of generated secrets
+	webhookSecretLength = 32
+	// maxWebhookResponseSize limits response body kept as delivery error
+	maxWebhookResponseSize = 256
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrInvalidWebhook  = errors.New("invalid webhook")
+)
+
+// Webhook is endpoint receiving signed proxy events
+type Webhook struct {
+	ID        uint      `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // Returned only when webhook is created
+	Events    []string  `json:"events"`           // Empty receives all events
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// receives reports whether webhook is subscribed to event
+func (w *Webhook) receives(event string) bool {
+	return len(w.Events) == 0 || slices.Contains(w.Events, event)
+}
+
+// WebhookDelivery is event queued for one webhook in the outbox
+type WebhookDelivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     uint            `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+// webhookPayload is body of webhook request
+type webhookPayload struct {
+	ID         string        `json:"id"` // Same for all webhooks receiving the event
+	Event      string        `json:"event"`
+	CreatedAt  time.Time     `json:"created_at"`
+	ProxyID    uint          `json:"proxy_id"`
+	Proxy      *webhookProxy `json:"proxy,omitempty"`       // Nil for deleted proxies
+	PreviousIP string        `json:"previous_ip,omitempty"` // Rotated only
+	IP         string        `json:"ip,omitempty"`          // Rotated only, empty if IP check failed
+	Error      string        `json:"error,omitempty"`
+}
+
+// webhookProxy is proxy as sent to webhooks. Payloads leave the server and
+// are kept in outbox, so API key, credentials and upstreams are left out.
+type webhookProxy struct {
+	ID          uint       `json:"id"`
+	Port        int        `json:"port"`
+	Mode        string     `json:"mode"`
+	Status      string     `json:"status"`
+	ServiceType string     `json:"service_type"`
+	EgressIP    string     `json:"egress_ip"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastResetAt time.Time  `json:"last_reset_at"`
+}
+
+func newWebhookProxy(proxy *models.Proxy) *webhookProxy {
+	if proxy == nil {
+		return nil
+	}
+	return &webhookProxy{
+		ID:          proxy.ID,
+		Port:        proxy.Port,
+		Mode:        proxy.Mode,
+		Status:      proxy.Status,
+		ServiceType: proxy.ServiceType,
+		EgressIP:    proxy.EgressIP,
+		ExpiresAt:   proxy.ExpiresAt,
+		LastResetAt: proxy.LastResetAt,
+	}
+}
+
+// WebhookDispatcher saves proxy events into outbox in database and sends
+// them to webhooks, retrying failed deliveries with exponential backoff
+type WebhookDispatcher struct {
+	db          *sql.DB
+	client      *http.Client
+	maxAttempts int
+	backoffMax  time.Duration
+	retention   time.Duration
+	signal      chan struct{}
+
+	// lastPrune is owned by the delivery loop
+	lastPrune time.Time
+}
+
+func NewWebhookDispatcher(mgr *Manager, db *sql.DB, cfg *config.Config) *WebhookDispatcher {
+	wd := &WebhookDispatcher{
+		db: db,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.WebhookTimeout) * time.Second,
+		},
+		maxAttempts: max(cfg.WebhookMaxAttempts, 1),
+		backoffMax:  max(time.Duration(cfg.WebhookBackoffMax)*time.Second, webhookRetryInterval),
+		retention:   time.Duration(cfg.WebhookRetentionDays) * 24 * time.Hour,
+		signal:      make(chan struct{}, 1),
+	}
+	mgr.Subscribe(wd.handleEvent)
+	return wd
+}
+
+// handleEvent saves event into outbox before manager call which emitted it
+// returns, so event is not lost if server stops before it is delivered.
+// Sending is left to the delivery loop, which is only woken up here.
+func (wd *WebhookDispatcher) handleEvent(event ProxyEvent) {
+	if !slices.Contains(WebhookEvents, webhookEventName(event.Kind)) {
+		return
+	}
+
+	saved, err := wd.saveEvent(event, time.Now())
+	if err != nil {
+		log.Printf("Failed to queue %s event of proxy %d: %v", webhookEventName(event.Kind), event.ProxyID, err)
+		return
+	}
+	if !saved {
+		return
+	}
+
+	select {
+	case wd.signal <- struct{}{}:
+	default:
+	}
+}
+
+func webhookEventName(kind ProxyEventKind) string {
+	return "proxy." + string(kind)
+}
+
+// saveEvent saves event into outbox for every webhook subscribed to it in
+// one transaction. Returns false if no webhook receives the event.
+func (wd *WebhookDispatcher) saveEvent(event ProxyEvent, at time.Time) (bool, error) {
+	name := webhookEventName(event.Kind)
+
+	webhooks, err := wd.ListWebhooks()
+	if err != nil {
+		return false, err
+	}
+	var targets []Webhook
+	for _, webhook := range webhooks {
+		if webhook.receives(name) {
+			targets = append(targets, webhook)
+		}
+	}
+	if len(targets) == 0 {
+		return false, nil
+	}
+
+	id, err := randomString(20)
+	if err != nil {
+		return false, fmt.Errorf("failed to generate event ID: %w", err)
+	}
+
+	payload := webhookPayload{
+		ID:        id,
+		Event:     name,
+		CreatedAt: at,
+		ProxyID:   event.ProxyID,
+		Proxy:     newWebhookProxy(event.Proxy),
+		Error:     event.Error,
+	}
+	if event.Kind == ProxyRotated {
+		payload.PreviousIP = event.PreviousIP
+		if event.Proxy.EgressError == "" {
+			payload.IP = event.Proxy.EgressIP
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode payload: %w", err)
+	}
+
+	tx, err := wd.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, webhook := range targets {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, 0, ?, ?)
+		`, webhook.ID, name, string(body), DeliveryPending, at, at)
+		if err != nil {
+			return false, fmt.Errorf("failed to save delivery for webhook %d: %w", webhook.ID, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to save deliveries: %w", err)
+	}
+	return true, nil
+}
+
+// Start sends due deliveries from outbox until ctx is cancelled. Pending
+// deliveries survive restarts and are sent once the loop runs again.
+func (wd *WebhookDispatcher) Start(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	log.Printf("WebhookDispatcher started with max attempts: %d, retry backoff: %v-%v", wd.maxAttempts, webhookRetryInterval, wd.backoffMax)
+
+	for {
+		wd.deliverDue(ctx)
+		wd.pruneIfDue()
+
+		select {
+		case <-ctx.Done():
+			log.Println("WebhookDispatcher stopped")
+			return
+		case <-ticker.C:
+		case <-wd.signal:
+		}
+	}
+}
+
+// deliverDue sends due deliveries in batches until none is left
+func (wd *WebhookDispatcher) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		batch, err := wd.dueDeliveries(webhookBatchSize)
+		if err != nil {
+			log.Printf("Failed to load webhook deliveries: %v", err)
+			return
+		}
+		if len(batch) == 0 {
+			return
+		}
+
+		var wg sync.WaitGroup
+		for _, due := range batch {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				wd.deliver(ctx, due)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// dueDelivery is delivery with endpoint it goes to
+type dueDelivery struct {
+	WebhookDelivery
+	url    string
+	secret string
+}
+
+func (wd *WebhookDispatcher) dueDeliveries(limit int) ([]dueDelivery, error) {
+	rows, err := wd.db.Query(`
+		SELECT d.id, d.webhook_id, d.event, d.payload, d.attempts, w.url, w.secret
+		FROM webhook_deliveries d
+		JOIN webhooks w ON w.id = d.webhook_id
+		WHERE d.status = ? AND d.next_attempt_at <= ?
+		ORDER BY d.next_attempt_at, d.id
+		LIMIT ?
+	`, DeliveryPending, time.Now(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []dueDelivery
+	for rows.Next() {
+		var (
+			d       dueDelivery
+			payload string
+		)
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Attempts, &d.url, &d.secret); err != nil {
+			return nil, err
+		}
+		d.Payload = json.RawMessage(payload)
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// deliver sends delivery once and saves outcome
+func (wd *WebhookDispatcher) deliver(ctx context.Context, d dueDelivery) {
+	sendErr := wd.send(ctx, d)
+	now := time.Now()
+	attempts := d.Attempts + 1
+
+	var err error
+	switch {
+	case sendErr == nil:
+		_, err = wd.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, last_error = '', next_attempt_at = NULL, delivered_at = ?
+			WHERE id = ?
+		`, DeliveryDelivered, attempts, now, d.ID)
+	case attempts >= wd.maxAttempts:
+		log.Printf("Giving up %s delivery %d to webhook %d after %d attempt(s): %v", d.Event, d.ID, d.WebhookID, attempts, sendErr)
+		_, err = wd.db.Exec(`
+			UPDATE webhook_deliveries
+			SET status = ?, attempts = ?, last_error = ?, next_attempt_at = NULL
+			WHERE id = ?
+		`, DeliveryFailed, attempts, sendErr.Error(), d.ID)
+	default:
+		nextAttemptAt := now.Add(wd.backoff(attempts))
+		log.Printf("Failed to deliver %s delivery %d to webhook %d (attempt %d), next attempt at %s: %v", d.Event, d.ID, d.WebhookID, attempts, nextAttemptAt.Format(time.RFC3339), sendErr)
+		_, err = wd.db.Exec(`
+			UPDATE webhook_deliveries
+			SET attempts = ?, last_error = ?, next_attempt_at = ?
+			WHERE id = ?
+		`, attempts, sendErr.Error(), nextAttemptAt, d.ID)
+	}
+	if err != nil {
+		log.Printf("Failed to save webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+func (wd *WebhookDispatcher) send(ctx context.Context, d dueDelivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.FormatInt(d.ID, 10))
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(d.secret, timestamp, d.Payload))
+
+	resp, err := wd.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize))
+		return fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookResponseSize))
+	return nil
+}
+
+// SignWebhook returns signature header value of webhook request:
+// "sha256=" followed by hex HMAC-SHA256 of "<timestamp>.<body>" keyed
+// with webhook secret
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns delay before next attempt after given number of failed
+// attempts: retry interval doubled per failure, up to cap
+func (wd *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := webhookRetryInterval
+	for i := 1; i < attempts && delay < wd.backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > wd.backoffMax {
+		delay = wd.backoffMax
+	}
+	return delay
+}
+
+// pruneIfDue deletes finished deliveries older than retention period, at
+// most once per hour
+func (wd *WebhookDispatcher) pruneIfDue() {
+	if wd.retention <= 0 || time.Since(wd.lastPrune) < time.Hour {
+		return
+	}
+	wd.lastPrune = time.Now()
+
+	cutoff := time.Now().Add(-wd.retention)
+	_, err := wd.db.Exec("DELETE FROM webhook_deliveries WHERE status <> ? AND created_at < ?", DeliveryPending, cutoff)
+	if err != nil {
+		log.Printf("Failed to prune webhook deliveries: %v", err)
+	}
+}
+
+// CreateWebhook registers endpoint for given events, all events if none
+// are given. Secret is generated when empty.
+func (wd *WebhookDispatcher) CreateWebhook(rawURL, secret string, events []string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w: url must be absolute http or https URL", ErrInvalidWebhook)
+	}
+	for _, event := range events {
+		if !slices.Contains(WebhookEvents, event) {
+			return nil, fmt.Errorf("%w: unknown event %q", ErrInvalidWebhook, event)
+		}
+	}
+
+	if secret == "" {
+		if secret, err = randomString(webhookSecretLength); err != nil {
+			return nil, err
+		}
+	}
+
+	webhook := &Webhook{
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    slices.Compact(slices.Sorted(slices.Values(events))),
+		CreatedAt: time.Now(),
+	}
+	if webhook.Events == nil {
+		webhook.Events = []string{}
+	}
+
+	result, err := wd.db.Exec(`
+		INSERT INTO webhooks (url, secret, events, created_at)
+		VALUES (?, ?, ?, ?)
+	`, webhook.URL, webhook.Secret, strings.Join(webhook.Events, ","), webhook.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert ID: %w", err)
+	}
+	webhook.ID = uint(id)
+
+	return webhook, nil
+}
+
+// ListWebhooks returns all webhooks with their secrets
+func (wd *WebhookDispatcher) ListWebhooks() ([]Webhook, error) {
+	rows, err := wd.db.Query("SELECT id, url, secret, events, created_at FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var (
+			webhook Webhook
+			events  string
+		)
+		if err := rows.Scan(&webhook.ID, &webhook.URL, &webhook.Secret, &events, &webhook.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %w", err)
+		}
+		webhook.Events = []string{}
+		if events != "" {
+			webhook.Events = strings.Split(events, ",")
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// DeleteWebhook removes webhook together with its queued deliveries
+func (wd *WebhookDispatcher) DeleteWebhook(id uint) error {
+	tx, err := wd.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	if _, err := tx.Exec("DELETE FROM webhook_deliveries WHERE webhook_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// Deliveries returns latest deliveries of webhook, newest first
+func (wd *WebhookDispatcher) Deliveries(webhookID uint, limit int) ([]WebhookDelivery, error) {
+	var exists bool
+	if err := wd.db.QueryRow("SELECT EXISTS(SELECT 1 FROM webhooks WHERE id = ?)", webhookID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to query webhook: %w", err)
+	}
+	if !exists {
+		return nil, ErrWebhookNotFound
+	}
+
+	rows, err := wd.db.Query(`
+		SELECT id, webhook_id, event, payload, status, attempts, last_error, next_attempt_at, delivered_at, created_at
+		FROM webhook_deliveries
+		WHERE webhook_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, webhookID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query webhook deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		var (
+			d             WebhookDelivery
+			payload       string
+			nextAttemptAt sql.NullTime
+			deliveredAt   sql.NullTime
+		)
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.LastError, &nextAttemptAt, &deliveredAt, &d.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		d.Payload = json.RawMessage(payload)
+		if nextAttemptAt.Valid {
+			d.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
@@ -0,0 +1,222 @@
+package proxymanager
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go-forward-proxy/internal/database"
+)
+
+func newTestWebhookDispatcher(t *testing.T) *WebhookDispatcher {
+	t.Helper()
+	db, err := database.InitDB(filepath.Join(t.TempDir(), "proxies.db"))
+	if err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &WebhookDispatcher{
+		db:          db,
+		maxAttempts: 10,
+		backoffMax:  time.Hour,
+		signal:      make(chan struct{}, 1),
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	cases := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{
+			name:      "event payload",
+			secret:    "whsec_test",
+			timestamp: "1700000000",
+			body:      `{"event":"proxy.created"}`,
+			want:      "sha256=37aeccb3e7f54e9bb157c8f21579247d4f5d73ecaf8a7f23181054d0c78b6cc0",
+		},
+		{
+			name:      "empty secret and body",
+			timestamp: "0",
+			want:      "sha256=b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := SignWebhook(tc.secret, tc.timestamp, []byte(tc.body)); got != tc.want {
+				t.Errorf("SignWebhook() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	cases := []struct {
+		backoffMax time.Duration
+		attempts   int
+		want       time.Duration
+	}{
+		{backoffMax: time.Minute, attempts: 0, want: 10 * time.Second},
+		{backoffMax: time.Minute, attempts: 1, want: 10 * time.Second},
+		{backoffMax: time.Minute, attempts: 2, want: 20 * time.Second},
+		{backoffMax: time.Minute, attempts: 3, want: 40 * time.Second},
+		{backoffMax: time.Minute, attempts: 4, want: time.Minute},
+		{backoffMax: time.Minute, attempts: 1000, want: time.Minute},
+		{backoffMax: 15 * time.Second, attempts: 2, want: 15 * time.Second},
+		{backoffMax: webhookRetryInterval, attempts: 5, want: webhookRetryInterval},
+	}
+
+	for _, tc := range cases {
+		wd := &WebhookDispatcher{backoffMax: tc.backoffMax}
+		if got := wd.backoff(tc.attempts); got != tc.want {
+			t.Errorf("backoff(%d) with cap %v = %v, want %v", tc.attempts, tc.backoffMax, got, tc.want)
+		}
+	}
+}
+
+func TestDueDeliveries(t *testing.T) {
+	wd := newTestWebhookDispatcher(t)
+	webhook, err := wd.CreateWebhook("https://example.com/hook", "secret", nil)
+	if err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+
+	now := time.Now()
+	rows := []struct {
+		webhookID     uint
+		status        string
+		nextAttemptAt *time.Time
+	}{
+		{webhook.ID, DeliveryPending, ptr(now.Add(-time.Minute))},   // 1: due
+		{webhook.ID, DeliveryPending, ptr(now.Add(-time.Hour))},     // 2: due earlier
+		{webhook.ID, DeliveryPending, ptr(now.Add(time.Hour))},      // 3: backing off
+		{webhook.ID, DeliveryDelivered, nil},                        // 4
+		{webhook.ID, DeliveryFailed, nil},                           // 5
+		{webhook.ID + 1, DeliveryPending, ptr(now.Add(-time.Hour))}, // 6: webhook is gone
+		{webhook.ID, DeliveryPending, ptr(now.Add(-time.Minute))},   // 7: due with 1
+	}
+	for _, row := range rows {
+		_, err := wd.db.Exec(`
+			INSERT INTO webhook_deliveries (webhook_id, event, payload, status, next_attempt_at, created_at)
+			VALUES (?, ?, '{}', ?, ?, ?)
+		`, row.webhookID, WebhookProxyCreated, row.status, row.nextAttemptAt, now)
+		if err != nil {
+			t.Fatalf("insert delivery: %v", err)
+		}
+	}
+
+	cases := []struct {
+		limit int
+		want  []int64
+	}{
+		{limit: 10, want: []int64{2, 1, 7}},
+		{limit: 2, want: []int64{2, 1}},
+	}
+
+	for _, tc := range cases {
+		deliveries, err := wd.dueDeliveries(tc.limit)
+		if err != nil {
+			t.Fatalf("dueDeliveries(%d): %v", tc.limit, err)
+		}
+
+		var got []int64
+		for _, d := range deliveries {
+			got = append(got, d.ID)
+			if d.url != webhook.URL || d.secret != webhook.Secret {
+				t.Errorf("delivery %d goes to %q with secret %q, want %q with %q", d.ID, d.url, d.secret, webhook.URL, webhook.Secret)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("dueDeliveries(%d) = %v, want %v", tc.limit, got, tc.want)
+		}
+	}
+}
+
+func TestWebhookEventSavedBeforeReturn(t *testing.T) {
+	wd := newTestWebhookDispatcher(t)
+	all, err := wd.CreateWebhook("https://example.com/all", "", nil)
+	if err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+	if _, err := wd.CreateWebhook("https://example.com/created", "", []string{WebhookProxyCreated}); err != nil {
+		t.Fatalf("CreateWebhook: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		event      ProxyEvent
+		wantSaved  []uint // Webhooks delivery is saved for
+		wantSignal bool
+	}{
+		{
+			name:       "event some webhooks receive",
+			event:      ProxyEvent{Kind: ProxyDeleted, ProxyID: 7},
+			wantSaved:  []uint{all.ID},
+			wantSignal: true,
+		},
+		{
+			name:  "event webhooks are not sent",
+			event: ProxyEvent{Kind: ProxyUpdated, ProxyID: 7},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := wd.db.Exec("DELETE FROM webhook_deliveries"); err != nil {
+				t.Fatalf("clear outbox: %v", err)
+			}
+			select {
+			case <-wd.signal:
+			default:
+			}
+
+			wd.handleEvent(tc.event)
+
+			// Delivery loop is not running, so rows come from handleEvent
+			got := savedDeliveries(t, wd.db)
+			if !reflect.DeepEqual(got, tc.wantSaved) {
+				t.Errorf("deliveries saved for webhooks %v, want %v", got, tc.wantSaved)
+			}
+			select {
+			case <-wd.signal:
+				if !tc.wantSignal {
+					t.Errorf("delivery loop woken up with nothing to send")
+				}
+			default:
+				if tc.wantSignal {
+					t.Errorf("delivery loop not woken up")
+				}
+			}
+		})
+	}
+}
+
+func savedDeliveries(t *testing.T, db *sql.DB) []uint {
+	t.Helper()
+	rows, err := db.Query("SELECT webhook_id FROM webhook_deliveries WHERE status = ? ORDER BY webhook_id", DeliveryPending)
+	if err != nil {
+		t.Fatalf("query outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var ids []uint
+	for rows.Next() {
+		var id uint
+		if err := rows.Scan(&id); err != nil {
+			t.Fatalf("scan outbox: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
@@ -0,0 +1,521 @@
+package proxyservices
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+)
+
+// Places of API key in provider request
+const (
+	KeyInQuery  = "query"  // Query parameter
+	KeyInPath   = "path"   // Replaces "{key}" in URL
+	KeyInHeader = "header" // Request header
+	KeyInJSON   = "json"   // Field of JSON body
+	KeyInForm   = "form"   // Field of form body
+)
+
+// Formats of time values in provider responses
+const (
+	TimeSeconds = "seconds" // Seconds from now, default for TTL
+	TimeUnix    = "unix"    // Unix timestamp in seconds
+	TimeUnixMs  = "unix_ms" // Unix timestamp in milliseconds
+)
+
+// maxGenericResponseSize limits body read from provider
+const maxGenericResponseSize = 1 << 20
+
+// GenericFile is file with configured providers
+type GenericFile struct {
+	Providers []GenericConfig `json:"providers"`
+}
+
+// GenericConfig describes provider with JSON HTTP API, so vendors with
+// common API shape need no code
+type GenericConfig struct {
+	Name     string          `json:"name"`    // Service type of proxies using the provider
+	Timeout  int             `json:"timeout"` // Seconds, default 30
+	Current  GenericEndpoint `json:"current"`
+	New      GenericEndpoint `json:"new"`
+	Response GenericResponse `json:"response"`
+
+	// OptionParams renames proxy options in new proxy request, e.g.
+	// {"location": "region_id"}. Options not listed keep their names.
+	OptionParams map[string]string `json:"option_params"`
+	// Options are choices listed by provider options endpoint
+	Options *ProviderOptions `json:"options"`
+}
+
+// GenericEndpoint is how to call one provider API
+type GenericEndpoint struct {
+	URL       string            `json:"url"`
+	Method    string            `json:"method"`     // Default GET
+	KeyIn     string            `json:"key_in"`     // One of KeyIn* values, default query
+	KeyName   string            `json:"key_name"`   // Query parameter, header or body field, default "key"
+	KeyPrefix string            `json:"key_prefix"` // Prepended to key, e.g. "Bearer "
+	Headers   map[string]string `json:"headers"`
+	Body      map[string]any    `json:"body"` // Extra parameters, sent in query for GET
+}
+
+// GenericResponse tells where values are in JSON response. Paths are dot
+// separated, array elements are addressed by index, e.g. "data.0.ip".
+type GenericResponse struct {
+	Proxy    string `json:"proxy"` // "ip:port" value, alternative to host and port
+	Host     string `json:"host"`
+	Port     string `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	SOCKS5   string `json:"socks5"` // "ip:port" of SOCKS5 endpoint with the same credentials, optional
+
+	TTL           string `json:"ttl"`            // Time until next rotation is allowed
+	TTLFormat     string `json:"ttl_format"`     // seconds (default), unix or unix_ms
+	ExpiresAt     string `json:"expires_at"`     // Expiry of provider key
+	ExpiresFormat string `json:"expires_format"` // unix, unix_ms or Go time layout, default RFC 3339
+	Timezone      string `json:"timezone"`       // Zone of layouts without offset, default UTC
+
+	Code           string   `json:"code"`             // Status code in body
+	SuccessCodes   []string `json:"success_codes"`    // Default: any code
+	NoCurrentCodes []string `json:"no_current_codes"` // Codes meaning GetNewProxy must be called
+	Message        string   `json:"message"`          // Error message
+}
+
+type GenericService struct {
+	config     GenericConfig
+	location   *time.Location
+	httpClient *http.Client
+}
+
+// NewGenericService validates provider config and creates service for it
+func NewGenericService(cfg GenericConfig) (*GenericService, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("provider name is required")
+	}
+	for name, endpoint := range map[string]GenericEndpoint{"current": cfg.Current, "new": cfg.New} {
+		if err := endpoint.validate(); err != nil {
+			return nil, fmt.Errorf("provider %s: %s endpoint: %w", cfg.Name, name, err)
+		}
+	}
+
+	resp := cfg.Response
+	if resp.Proxy == "" && (resp.Host == "" || resp.Port == "") {
+		return nil, fmt.Errorf("provider %s: response needs proxy path, or host and port paths", cfg.Name)
+	}
+	if (resp.Username == "") != (resp.Password == "") {
+		return nil, fmt.Errorf("provider %s: response needs both username and password paths, or neither", cfg.Name)
+	}
+	switch resp.TTLFormat {
+	case "", TimeSeconds, TimeUnix, TimeUnixMs:
+	default:
+		return nil, fmt.Errorf("provider %s: unknown ttl_format %q", cfg.Name, resp.TTLFormat)
+	}
+
+	location := time.UTC
+	if resp.Timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(resp.Timezone); err != nil {
+			return nil, fmt.Errorf("provider %s: %w", cfg.Name, err)
+		}
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 30
+	}
+
+	return &GenericService{
+		config:   cfg,
+		location: location,
+		httpClient: &http.Client{
+			Timeout: time.Duration(timeout) * time.Second,
+		},
+	}, nil
+}
+
+func (e *GenericEndpoint) validate() error {
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("url must be absolute http or https URL")
+	}
+
+	switch e.KeyIn {
+	case "", KeyInQuery, KeyInHeader, KeyInJSON, KeyInForm:
+	case KeyInPath:
+		if !strings.Contains(e.URL, "{key}") {
+			return fmt.Errorf("url must contain {key} when key_in is path")
+		}
+	default:
+		return fmt.Errorf("unknown key_in %q", e.KeyIn)
+	}
+	return nil
+}
+
+// LoadGenericServices reads providers file and registers its providers
+func LoadGenericServices(registry *Registry, path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read providers file: %w", err)
+	}
+
+	var file GenericFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse providers file: %w", err)
+	}
+
+	names := make([]string, 0, len(file.Providers))
+	for _, cfg := range file.Providers {
+		service, err := NewGenericService(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.Register(service); err != nil {
+			return nil, err
+		}
+		names = append(names, cfg.Name)
+	}
+
+	return names, nil
+}
+
+func (s *GenericService) GetServiceType() string {
+	return s.config.Name
+}
+
+func (s *GenericService) GetCurrentProxy(ctx context.Context, apiKey string) (*ProxyInfo, error) {
+	return s.call(ctx, s.config.Current, apiKey, nil, true)
+}
+
+func (s *GenericService) GetNewProxy(ctx context.Context, apiKey string, options Options) (*ProxyInfo, error) {
+	params := make(map[string]any, len(options))
+	for name, value := range options {
+		if param, ok := s.config.OptionParams[name]; ok {
+			name = param
+		}
+		params[name] = value
+	}
+	return s.call(ctx, s.config.New, apiKey, params, false)
+}
+
+// ListOptions returns options listed in provider config
+func (s *GenericService) ListOptions(ctx context.Context) (*ProviderOptions, error) {
+	if s.config.Options == nil {
+		return nil, ErrOptionsNotSupported
+	}
+	return s.config.Options, nil
+}
+
+func (s *GenericService) call(ctx context.Context, endpoint GenericEndpoint, apiKey string, params map[string]any, current bool) (*ProxyInfo, error) {
+	req, err := s.newRequest(ctx, endpoint, apiKey, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Numbers are kept as written, so codes and timestamps are not rounded
+	var body any
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxGenericResponseSize))
+	decoder.UseNumber()
+	if err := decoder.Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode response (status %d): %w", resp.StatusCode, err)
+	}
+
+	if err := s.checkError(body, resp.StatusCode, current); err != nil {
+		return nil, err
+	}
+
+	return s.proxyInfo(body)
+}
+
+// newRequest builds provider request. Params are added to configured
+// body fields, options of proxy override them.
+func (s *GenericService) newRequest(ctx context.Context, endpoint GenericEndpoint, apiKey string, params map[string]any) (*http.Request, error) {
+	method := endpoint.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	keyName := endpoint.KeyName
+	if keyName == "" {
+		keyName = "key"
+	}
+	key := endpoint.KeyPrefix + apiKey
+
+	rawURL := endpoint.URL
+	if endpoint.KeyIn == KeyInPath {
+		rawURL = strings.ReplaceAll(rawURL, "{key}", url.PathEscape(key))
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]any, len(endpoint.Body)+len(params)+1)
+	for name, value := range endpoint.Body {
+		fields[name] = value
+	}
+	for name, value := range params {
+		fields[name] = value
+	}
+
+	query := u.Query()
+	if endpoint.KeyIn == "" || endpoint.KeyIn == KeyInQuery {
+		query.Set(keyName, key)
+	}
+	// GET and HEAD requests carry no body, parameters go to query
+	if method == http.MethodGet || method == http.MethodHead {
+		for name, value := range fields {
+			query.Set(name, fmt.Sprint(value))
+		}
+		clear(fields)
+	}
+	u.RawQuery = query.Encode()
+
+	var (
+		body        io.Reader
+		contentType string
+	)
+	switch {
+	case endpoint.KeyIn == KeyInForm:
+		form := url.Values{}
+		for name, value := range fields {
+			form.Set(name, fmt.Sprint(value))
+		}
+		form.Set(keyName, key)
+		body = strings.NewReader(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case endpoint.KeyIn == KeyInJSON || len(fields) > 0:
+		if endpoint.KeyIn == KeyInJSON {
+			fields[keyName] = key
+		}
+		data, err := json.Marshal(fields)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range endpoint.Headers {
+		req.Header.Set(name, value)
+	}
+	if endpoint.KeyIn == KeyInHeader {
+		req.Header.Set(keyName, key)
+	}
+
+	return req, nil
+}
+
+// checkError turns error response into error, ErrNoCurrentProxy if code
+// says provider has no current proxy for the key
+func (s *GenericService) checkError(body any, status int, current bool) error {
+	resp := s.config.Response
+
+	var message string
+	if resp.Message != "" {
+		if value, ok := lookupPath(body, resp.Message); ok {
+			message = stringValue(value)
+		}
+	}
+
+	if resp.Code != "" {
+		value, ok := lookupPath(body, resp.Code)
+		if !ok {
+			return fmt.Errorf("%s API error: status %d, no code in response", s.config.Name, status)
+		}
+		code := stringValue(value)
+		if current && slices.Contains(resp.NoCurrentCodes, code) {
+			return ErrNoCurrentProxy
+		}
+		if len(resp.SuccessCodes) > 0 && !slices.Contains(resp.SuccessCodes, code) {
+			return fmt.Errorf("%s API error: code=%s, message=%s", s.config.Name, code, message)
+		}
+	}
+
+	if status < 200 || status > 299 {
+		return fmt.Errorf("%s API error: status %d, message=%s", s.config.Name, status, message)
+	}
+	return nil
+}
+
+func (s *GenericService) proxyInfo(body any) (*ProxyInfo, error) {
+	resp := s.config.Response
+
+	var address string
+	if resp.Proxy != "" {
+		value, err := requiredString(body, resp.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		address = value
+	} else {
+		host, err := requiredString(body, resp.Host)
+		if err != nil {
+			return nil, err
+		}
+		port, err := requiredString(body, resp.Port)
+		if err != nil {
+			return nil, err
+		}
+		address = net.JoinHostPort(host, port)
+	}
+
+	var username, password string
+	if resp.Username != "" {
+		u, _ := lookupPath(body, resp.Username)
+		p, _ := lookupPath(body, resp.Password)
+		username, password = stringValue(u), stringValue(p)
+	}
+
+	upstream, err := models.NewUpstream(models.UpstreamSchemeHTTP, address, username, password)
+	if err != nil {
+		return nil, err
+	}
+	info := &ProxyInfo{
+		Upstream:    upstream,
+		ServiceType: s.config.Name,
+	}
+
+	// SOCKS5 endpoint is optional, missing value leaves proxy HTTP only
+	if resp.SOCKS5 != "" {
+		if value, ok := lookupPath(body, resp.SOCKS5); ok {
+			if address := stringValue(value); address != "" {
+				socks5, err := models.NewUpstream(models.UpstreamSchemeSOCKS5, address, username, password)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse socks5: %w", err)
+				}
+				info.SOCKS5 = socks5
+			}
+		}
+	}
+
+	// Not every API returns TTL and expiry, missing values stay zero
+	if value, ok := lookupPath(body, resp.TTL); ok {
+		ttl, err := s.ttlSeconds(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ttl: %w", err)
+		}
+		info.NextResetAfter = ttl
+	}
+	if value, ok := lookupPath(body, resp.ExpiresAt); ok {
+		expiresAt, err := s.parseTime(value, resp.ExpiresFormat)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse expires_at: %w", err)
+		}
+		info.ExpiresAt = expiresAt
+	}
+
+	return info, nil
+}
+
+// ttlSeconds returns seconds until next rotation is allowed
+func (s *GenericService) ttlSeconds(value any) (int, error) {
+	format := s.config.Response.TTLFormat
+	if format == "" || format == TimeSeconds {
+		seconds, err := strconv.ParseFloat(stringValue(value), 64)
+		if err != nil {
+			return 0, err
+		}
+		return max(int(seconds), 0), nil
+	}
+
+	at, err := s.parseTime(value, format)
+	if err != nil || at.IsZero() {
+		return 0, err
+	}
+	return max(int(time.Until(at).Seconds()), 0), nil
+}
+
+// parseTime parses time value in given format, zero value means unknown
+func (s *GenericService) parseTime(value any, format string) (time.Time, error) {
+	str := stringValue(value)
+	if str == "" || str == "0" {
+		return time.Time{}, nil
+	}
+
+	switch format {
+	case TimeUnix, TimeUnixMs:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if format == TimeUnix {
+			return time.Unix(n, 0), nil
+		}
+		return time.UnixMilli(n), nil
+	case "":
+		format = time.RFC3339
+	}
+	return time.ParseInLocation(format, str, s.location)
+}
+
+func requiredString(body any, path string) (string, error) {
+	value, ok := lookupPath(body, path)
+	if !ok || stringValue(value) == "" {
+		return "", fmt.Errorf("no %s in response", path)
+	}
+	return stringValue(value), nil
+}
+
+// lookupPath finds value at dot separated path in decoded JSON
+func lookupPath(value any, path string) (any, bool) {
+	if path == "" {
+		return nil, false
+	}
+
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]any:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+
+	return value, value != nil
+}
+
+// stringValue formats JSON scalar as written in response
+func stringValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,345 @@
+package proxyservices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// providerServer answers every request with given status and body and
+// hands captured requests to the test
+func providerServer(t *testing.T, status int, body string) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(strings.NewReader(string(data)))
+		requests <- r
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+func newTestGenericService(t *testing.T, cfg GenericConfig) *GenericService {
+	t.Helper()
+	service, err := NewGenericService(cfg)
+	if err != nil {
+		t.Fatalf("NewGenericService: %v", err)
+	}
+	return service
+}
+
+func TestGenericServiceResponsePaths(t *testing.T) {
+	expiresAt := time.Date(2026, 12, 31, 23, 59, 0, 0, time.UTC)
+	server, _ := providerServer(t, http.StatusOK, `{
+		"code": 0,
+		"data": {
+			"proxies": [{"ip": "203.0.113.7", "port": 8080, "socks_port": "203.0.113.7:1080"}],
+			"auth": {"user": "u", "pass": "p:@w"},
+			"next_change": 42,
+			"expired": "2026-12-31 23:59"
+		}
+	}`)
+
+	service := newTestGenericService(t, GenericConfig{
+		Name:    "vendor",
+		Current: GenericEndpoint{URL: server.URL + "/current"},
+		New:     GenericEndpoint{URL: server.URL + "/new"},
+		Response: GenericResponse{
+			Host:          "data.proxies.0.ip",
+			Port:          "data.proxies.0.port",
+			Username:      "data.auth.user",
+			Password:      "data.auth.pass",
+			SOCKS5:        "data.proxies.0.socks_port",
+			TTL:           "data.next_change",
+			ExpiresAt:     "data.expired",
+			ExpiresFormat: "2006-01-02 15:04",
+			Code:          "code",
+			SuccessCodes:  []string{"0"},
+		},
+	})
+
+	info, err := service.GetCurrentProxy(context.Background(), "secret")
+	if err != nil {
+		t.Fatalf("GetCurrentProxy: %v", err)
+	}
+
+	if info.Upstream.Host != "203.0.113.7" || info.Upstream.Port != 8080 {
+		t.Errorf("upstream = %s:%d, want 203.0.113.7:8080", info.Upstream.Host, info.Upstream.Port)
+	}
+	if info.Upstream.Username != "u" || info.Upstream.Password != "p:@w" {
+		t.Errorf("upstream credentials = %q/%q, want u/p:@w", info.Upstream.Username, info.Upstream.Password)
+	}
+	if info.SOCKS5 == nil || info.SOCKS5.Port != 1080 || info.SOCKS5.Password != "p:@w" {
+		t.Errorf("socks5 = %+v, want port 1080 with upstream credentials", info.SOCKS5)
+	}
+	if info.NextResetAfter != 42 {
+		t.Errorf("NextResetAfter = %d, want 42", info.NextResetAfter)
+	}
+	if !info.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("ExpiresAt = %v, want %v", info.ExpiresAt, expiresAt)
+	}
+	if info.ServiceType != "vendor" {
+		t.Errorf("ServiceType = %q, want vendor", info.ServiceType)
+	}
+}
+
+func TestGenericServiceMissingProxy(t *testing.T) {
+	server, _ := providerServer(t, http.StatusOK, `{"data": {}}`)
+
+	service := newTestGenericService(t, GenericConfig{
+		Name:     "vendor",
+		Current:  GenericEndpoint{URL: server.URL},
+		New:      GenericEndpoint{URL: server.URL},
+		Response: GenericResponse{Proxy: "data.proxy"},
+	})
+
+	if _, err := service.GetCurrentProxy(context.Background(), "secret"); err == nil || !strings.Contains(err.Error(), "no data.proxy in response") {
+		t.Errorf("GetCurrentProxy error = %v, want missing data.proxy", err)
+	}
+}
+
+func TestGenericServiceRequests(t *testing.T) {
+	cases := []struct {
+		name     string
+		path     string
+		endpoint GenericEndpoint
+		options  Options
+		check    func(t *testing.T, r *http.Request)
+	}{
+		{
+			name: "key in path, options in query of GET",
+			path: "/keys/{key}/rotate",
+			endpoint: GenericEndpoint{
+				KeyIn: KeyInPath,
+				Body:  map[string]any{"format": "json", "region_id": 1},
+			},
+			options: Options{OptionLocation: 5, OptionISP: "viettel"},
+			check: func(t *testing.T, r *http.Request) {
+				if r.URL.Path != "/keys/a b/rotate" {
+					t.Errorf("path = %q, want /keys/a b/rotate", r.URL.Path)
+				}
+				query := r.URL.Query()
+				if query.Get("format") != "json" {
+					t.Errorf("format = %q, want json", query.Get("format"))
+				}
+				// Options are renamed and override configured fields
+				if query.Get("region_id") != "5" || query.Has("location") {
+					t.Errorf("query = %v, want region_id=5 without location", query)
+				}
+				if query.Get("isp") != "viettel" {
+					t.Errorf("isp = %q, want viettel", query.Get("isp"))
+				}
+				if query.Has("key") {
+					t.Errorf("key must not be in query when key_in is path")
+				}
+			},
+		},
+		{
+			name: "key in header with prefix",
+			endpoint: GenericEndpoint{
+				KeyIn:     KeyInHeader,
+				KeyName:   "Authorization",
+				KeyPrefix: "Bearer ",
+				Headers:   map[string]string{"X-Client": "forward-proxy"},
+			},
+			check: func(t *testing.T, r *http.Request) {
+				if got := r.Header.Get("Authorization"); got != "Bearer a b" {
+					t.Errorf("Authorization = %q, want %q", got, "Bearer a b")
+				}
+				if got := r.Header.Get("X-Client"); got != "forward-proxy" {
+					t.Errorf("X-Client = %q, want forward-proxy", got)
+				}
+			},
+		},
+		{
+			name: "key and options in JSON body of POST",
+			endpoint: GenericEndpoint{
+				Method:  http.MethodPost,
+				KeyIn:   KeyInJSON,
+				KeyName: "api_key",
+				Body:    map[string]any{"protocol": "http"},
+			},
+			options: Options{OptionLocation: 5},
+			check: func(t *testing.T, r *http.Request) {
+				if got := r.Header.Get("Content-Type"); got != "application/json" {
+					t.Errorf("Content-Type = %q, want application/json", got)
+				}
+				var body map[string]any
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Fatalf("decode body: %v", err)
+				}
+				if body["api_key"] != "a b" || body["protocol"] != "http" || body["region_id"] != float64(5) {
+					t.Errorf("body = %v, want api_key, protocol and region_id", body)
+				}
+			},
+		},
+		{
+			name: "key in form body",
+			endpoint: GenericEndpoint{
+				Method: http.MethodPost,
+				KeyIn:  KeyInForm,
+			},
+			check: func(t *testing.T, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Fatalf("ParseForm: %v", err)
+				}
+				if got := r.PostForm.Get("key"); got != "a b" {
+					t.Errorf("key = %q, want %q", got, "a b")
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, requests := providerServer(t, http.StatusOK, `{"proxy": "203.0.113.7:8080"}`)
+
+			endpoint := tc.endpoint
+			endpoint.URL = server.URL + tc.path
+			service := newTestGenericService(t, GenericConfig{
+				Name:         "vendor",
+				Current:      endpoint,
+				New:          endpoint,
+				Response:     GenericResponse{Proxy: "proxy"},
+				OptionParams: map[string]string{OptionLocation: "region_id"},
+			})
+
+			if _, err := service.GetNewProxy(context.Background(), "a b", tc.options); err != nil {
+				t.Fatalf("GetNewProxy: %v", err)
+			}
+			tc.check(t, <-requests)
+		})
+	}
+}
+
+func TestGenericServiceErrors(t *testing.T) {
+	response := GenericResponse{
+		Proxy:          "proxy",
+		Code:           "code",
+		SuccessCodes:   []string{"0"},
+		NoCurrentCodes: []string{"27"},
+		Message:        "message",
+	}
+
+	cases := []struct {
+		name    string
+		status  int
+		body    string
+		current bool
+		wantErr string
+		wantIs  error
+	}{
+		{
+			name:    "error status",
+			status:  http.StatusUnauthorized,
+			body:    `{"code": 0, "message": "bad key"}`,
+			wantErr: "vendor API error: status 401, message=bad key",
+		},
+		{
+			name:    "error code",
+			status:  http.StatusOK,
+			body:    `{"code": 5, "message": "out of stock"}`,
+			wantErr: "vendor API error: code=5, message=out of stock",
+		},
+		{
+			name:    "missing code",
+			status:  http.StatusBadGateway,
+			body:    `{"error": "upstream down"}`,
+			wantErr: "vendor API error: status 502, no code in response",
+		},
+		{
+			name:    "no current proxy",
+			status:  http.StatusOK,
+			body:    `{"code": 27, "message": "no proxy"}`,
+			current: true,
+			wantIs:  ErrNoCurrentProxy,
+		},
+		{
+			name:    "no current code on new proxy request",
+			status:  http.StatusOK,
+			body:    `{"code": 27, "message": "no proxy"}`,
+			wantErr: "vendor API error: code=27, message=no proxy",
+		},
+		{
+			name:    "body is not JSON",
+			status:  http.StatusInternalServerError,
+			body:    `Internal Server Error`,
+			wantErr: "failed to decode response (status 500)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, _ := providerServer(t, tc.status, tc.body)
+			service := newTestGenericService(t, GenericConfig{
+				Name:     "vendor",
+				Current:  GenericEndpoint{URL: server.URL},
+				New:      GenericEndpoint{URL: server.URL},
+				Response: response,
+			})
+
+			var err error
+			if tc.current {
+				_, err = service.GetCurrentProxy(context.Background(), "secret")
+			} else {
+				_, err = service.GetNewProxy(context.Background(), "secret", nil)
+			}
+
+			switch {
+			case err == nil:
+				t.Fatalf("got no error")
+			case tc.wantIs != nil && !errors.Is(err, tc.wantIs):
+				t.Errorf("error = %v, want %v", err, tc.wantIs)
+			case tc.wantErr != "" && !strings.Contains(err.Error(), tc.wantErr):
+				t.Errorf("error = %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegistryRejectsShadowedProvider(t *testing.T) {
+	registry := NewRegistry()
+	builtin := NewTMProxyService()
+	if err := registry.Register(builtin); err != nil {
+		t.Fatalf("Register built-in: %v", err)
+	}
+
+	shadow := newTestGenericService(t, GenericConfig{
+		Name:     "tmproxy",
+		Current:  GenericEndpoint{URL: "https://example.com/current"},
+		New:      GenericEndpoint{URL: "https://example.com/new"},
+		Response: GenericResponse{Proxy: "proxy"},
+	})
+	if err := registry.Register(shadow); err == nil {
+		t.Errorf("Register configured tmproxy succeeded, want error")
+	}
+
+	// The same applies to providers loaded from file
+	path := filepath.Join(t.TempDir(), "providers.json")
+	data, err := json.Marshal(GenericFile{Providers: []GenericConfig{shadow.config}})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := LoadGenericServices(registry, path); err == nil {
+		t.Errorf("LoadGenericServices with tmproxy provider succeeded, want error")
+	}
+
+	if service, _ := registry.Get("tmproxy"); service != builtin {
+		t.Errorf("tmproxy service = %T, want built-in service", service)
+	}
+}
@@ -1,18 +1,27 @@
 package proxyservices
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"go-forward-proxy/internal/database/models"
+)
 
 // ProxyInfo holds the proxy information returned by external services
 type ProxyInfo struct {
-	ProxyStr       string    // Format: "ip:port:username:password" or "ip:port"
-	ServiceType    string    // "tmproxy" or "kiotproxy"
-	NextResetAfter int       // Seconds until next reset is allowed
-	ExpiresAt      time.Time // When proxy expires
+	Upstream       *models.Upstream // HTTP endpoint
+	SOCKS5         *models.Upstream // SOCKS5 endpoint, nil if provider has none
+	ServiceType    string           // Service type of provider, e.g. "tmproxy"
+	NextResetAfter int              // Seconds until next reset is allowed
+	ExpiresAt      time.Time        // When proxy expires
 }
 
-// ProxyService defines the interface for external proxy services
+// ProxyService defines the interface for external proxy services. Calls
+// are cancelled when ctx is done.
 type ProxyService interface {
-	GetCurrentProxy(apiKey string) (*ProxyInfo, error)
-	GetNewProxy(apiKey string) (*ProxyInfo, error)
+	GetCurrentProxy(ctx context.Context, apiKey string) (*ProxyInfo, error)
+	// GetNewProxy requests new proxy with per-proxy options, nil options
+	// mean provider defaults
+	GetNewProxy(ctx context.Context, apiKey string, options Options) (*ProxyInfo, error)
 	GetServiceType() string
 }
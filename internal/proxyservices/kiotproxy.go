@@ -1,10 +1,14 @@
 package proxyservices
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"time"
+
+	"go-forward-proxy/internal/database/models"
 )
 
 const (
@@ -46,15 +50,34 @@ type kiotproxyCurrentProxyResponse struct {
 		NextRequestAt int64  `json:"nextRequestAt"` // Unix timestamp in milliseconds
 		ExpirationAt  int64  `json:"expirationAt"`  // Unix timestamp in milliseconds
 		HTTP          string `json:"http"`          // Format: "ip:port"
+		SOCKS5        string `json:"socks5"`        // Format: "ip:port"
 		TTC           int    `json:"ttc"`           // Time to change in seconds
 	} `json:"data"`
 }
 
-func (s *KiotProxyService) GetCurrentProxy(apiKey string) (*ProxyInfo, error) {
+// kiotproxyUpstreams builds HTTP and SOCKS5 endpoints from "ip:port"
+// addresses KiotProxy returned, KiotProxy endpoints need no credentials.
+// SOCKS5 one is nil if address is missing.
+func kiotproxyUpstreams(httpAddress, socks5 string) (*models.Upstream, *models.Upstream, error) {
+	httpUpstream, err := models.NewUpstream(models.UpstreamSchemeHTTP, httpAddress, "", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse http: %w", err)
+	}
+	if socks5 == "" {
+		return httpUpstream, nil, nil
+	}
+	socks5Upstream, err := models.NewUpstream(models.UpstreamSchemeSOCKS5, socks5, "", "")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse socks5: %w", err)
+	}
+	return httpUpstream, socks5Upstream, nil
+}
+
+func (s *KiotProxyService) GetCurrentProxy(ctx context.Context, apiKey string) (*ProxyInfo, error) {
 	// Make HTTP request with API key as query parameter
 	url := fmt.Sprintf("%s?key=%s", kiotproxyGetCurrentURL, apiKey)
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -75,22 +98,36 @@ func (s *KiotProxyService) GetCurrentProxy(apiKey string) (*ProxyInfo, error) {
 		return nil, fmt.Errorf("kiotproxy API error: %s", kiotResp.Message)
 	}
 
-	// Convert unix milliseconds to time.Time
-	expiresAt := time.Unix(0, kiotResp.Data.ExpirationAt*int64(time.Millisecond))
+	upstream, socks5, err := kiotproxyUpstreams(kiotResp.Data.HTTP, kiotResp.Data.SOCKS5)
+	if err != nil {
+		return nil, err
+	}
+
+	// Convert unix milliseconds to time.Time, zero if not reported
+	var expiresAt time.Time
+	if kiotResp.Data.ExpirationAt > 0 {
+		expiresAt = time.UnixMilli(kiotResp.Data.ExpirationAt)
+	}
 
 	return &ProxyInfo{
-		ProxyStr:       kiotResp.Data.HTTP,
+		Upstream:       upstream,
+		SOCKS5:         socks5,
 		ServiceType:    "kiotproxy",
 		NextResetAfter: kiotResp.Data.TTC,
 		ExpiresAt:      expiresAt,
 	}, nil
 }
 
-func (s *KiotProxyService) GetNewProxy(apiKey string) (*ProxyInfo, error) {
-	// Make HTTP request with API key as query parameter
-	url := fmt.Sprintf("%s?key=%s", kiotproxyGetNewURL, apiKey)
+func (s *KiotProxyService) GetNewProxy(ctx context.Context, apiKey string, options Options) (*ProxyInfo, error) {
+	// Make HTTP request with API key and options as query parameters
+	query := url.Values{}
+	for name, value := range options {
+		query.Set(name, fmt.Sprint(value))
+	}
+	query.Set("key", apiKey)
+	url := kiotproxyGetNewURL + "?" + query.Encode()
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -111,14 +148,16 @@ func (s *KiotProxyService) GetNewProxy(apiKey string) (*ProxyInfo, error) {
 		return nil, fmt.Errorf("kiotproxy API error: %s", kiotResp.Message)
 	}
 
-	// Format proxy string: "ip:port" (no separate credentials for KiotProxy)
-	// Use HTTP proxy format (can also use SOCKS5)
-	proxyStr := kiotResp.Data.HTTP
+	upstream, socks5, err := kiotproxyUpstreams(kiotResp.Data.HTTP, kiotResp.Data.SOCKS5)
+	if err != nil {
+		return nil, err
+	}
 
 	// Note: GetNewProxy response doesn't include NextResetAfter and ExpiresAt
 	// These fields should be populated by calling GetCurrentProxy after getting new proxy
 	return &ProxyInfo{
-		ProxyStr:    proxyStr,
+		Upstream:    upstream,
+		SOCKS5:      socks5,
 		ServiceType: "kiotproxy",
 	}, nil
 }
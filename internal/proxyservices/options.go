@@ -0,0 +1,95 @@
+package proxyservices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Common provider options. Other keys are vendor-specific parameters
+// passed to provider as they are.
+const (
+	OptionLocation = "location"
+	OptionISP      = "isp"
+)
+
+// ErrInvalidOptions is returned for provider options provider can't use
+var ErrInvalidOptions = errors.New("invalid provider options")
+
+// ErrOptionsNotSupported is returned by ListProviderOptions for providers
+// which can't list their options
+var ErrOptionsNotSupported = errors.New("provider does not list its options")
+
+// Options are per-proxy parameters of new proxy requests, e.g. location
+// and ISP of exit
+type Options map[string]any
+
+// Int returns integer option, ok is false if option is not set
+func (o Options) Int(name string) (value int, ok bool, err error) {
+	raw, ok := o[name]
+	if !ok || raw == nil {
+		return 0, false, nil
+	}
+
+	switch v := raw.(type) {
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), true, nil
+		}
+	case int:
+		return v, true, nil
+	case json.Number:
+		if n, err := strconv.Atoi(v.String()); err == nil {
+			return n, true, nil
+		}
+	case string:
+		if n, err := strconv.Atoi(v); err == nil {
+			return n, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%w: %s must be integer", ErrInvalidOptions, name)
+}
+
+// ProviderOption is one choice of provider option, e.g. a location
+type ProviderOption struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ProviderOptions lists choices of common options supported by provider
+type ProviderOptions struct {
+	Locations []ProviderOption `json:"locations"`
+	ISPs      []ProviderOption `json:"isps"`
+}
+
+// OptionsLister is implemented by providers which can list their options
+type OptionsLister interface {
+	ListOptions(ctx context.Context) (*ProviderOptions, error)
+}
+
+// OptionsValidator is implemented by providers which check options before
+// proxy is saved
+type OptionsValidator interface {
+	ValidateOptions(options Options) error
+}
+
+// ValidateOptions checks options with provider, if it can check them
+func ValidateOptions(service ProxyService, options Options) error {
+	validator, ok := service.(OptionsValidator)
+	if !ok {
+		return nil
+	}
+	return validator.ValidateOptions(options)
+}
+
+// ListProviderOptions returns options supported by provider, or
+// ErrOptionsNotSupported if provider can't list them
+func ListProviderOptions(ctx context.Context, service ProxyService) (*ProviderOptions, error) {
+	lister, ok := service.(OptionsLister)
+	if !ok {
+		return nil, ErrOptionsNotSupported
+	}
+	return lister.ListOptions(ctx)
+}
@@ -0,0 +1,59 @@
+package proxyservices
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Registry holds proxy services by their service type
+type Registry struct {
+	mu       sync.RWMutex
+	services map[string]ProxyService
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]ProxyService),
+	}
+}
+
+// Register adds service under its service type. Service types must be
+// unique, so configured provider can't shadow built-in one.
+func (r *Registry) Register(service ProxyService) error {
+	name := service.GetServiceType()
+	if name == "" {
+		return fmt.Errorf("service type must not be empty")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.services[name]; ok {
+		return fmt.Errorf("service type %q is already registered", name)
+	}
+	r.services[name] = service
+	return nil
+}
+
+// Get returns service registered under service type
+func (r *Registry) Get(serviceType string) (ProxyService, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	service, ok := r.services[serviceType]
+	return service, ok
+}
+
+// Names returns registered service types, sorted
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.services))
+	for name := range r.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -2,22 +2,35 @@ package proxyservices
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"time"
+
+	"go-forward-proxy/internal/database/models"
 )
 
 const (
 	tmproxyGetNewURL     = "https://tmproxy.com/api/proxy/get-new-proxy"
 	tmproxyGetCurrentURL = "https://tmproxy.com/api/proxy/get-current-proxy"
+	tmproxyLocationURL   = "https://tmproxy.com/api/proxy/location"
+)
+
+// Location and ISP requested when proxy has no options
+const (
+	tmproxyDefaultLocation = 1
+	tmproxyDefaultISP      = 1
 )
 
 var (
 	ErrNoCurrentProxy = errors.New("no current proxy available, need to call GetNewProxy")  // Exported (starts with uppercase)
 )
 
+// tmproxyLocation is time zone of timestamps returned by TMProxy (Vietnam time)
+var tmproxyLocation = time.FixedZone("ICT", 7*60*60)
+
 type TMProxyService struct {
 	httpClient *http.Client
 }
@@ -35,9 +48,7 @@ func (s *TMProxyService) GetServiceType() string {
 }
 
 type tmproxyRequest struct {
-	APIKey     string `json:"api_key"`
-	IDLocation int    `json:"id_location,omitempty"`
-	IDISP      int    `json:"id_isp,omitempty"`
+	APIKey string `json:"api_key"`
 }
 
 type tmproxyNewProxyResponse struct {
@@ -60,12 +71,30 @@ type tmproxyCurrentProxyResponse struct {
 		NextRequest int    `json:"next_request"` // Seconds
 		ExpiredAt   string `json:"expired_at"`   // ISO timestamp
 		HTTPS       string `json:"https"`        // Format: "ip:port"
+		SOCKS5      string `json:"socks5"`       // Format: "ip:port"
 		Username    string `json:"username"`
 		Password    string `json:"password"`
 	} `json:"data"`
 }
 
-func (s *TMProxyService) GetCurrentProxy(apiKey string) (*ProxyInfo, error) {
+// tmproxyUpstreams builds HTTP and SOCKS5 endpoints from "ip:port"
+// addresses TMProxy returned. SOCKS5 one is nil if address is missing.
+func tmproxyUpstreams(https, socks5, username, password string) (*models.Upstream, *models.Upstream, error) {
+	httpUpstream, err := models.NewUpstream(models.UpstreamSchemeHTTP, https, username, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse https: %w", err)
+	}
+	if socks5 == "" {
+		return httpUpstream, nil, nil
+	}
+	socks5Upstream, err := models.NewUpstream(models.UpstreamSchemeSOCKS5, socks5, username, password)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse socks5: %w", err)
+	}
+	return httpUpstream, socks5Upstream, nil
+}
+
+func (s *TMProxyService) GetCurrentProxy(ctx context.Context, apiKey string) (*ProxyInfo, error) {
 	// Prepare request
 	reqBody := tmproxyRequest{
 		APIKey: apiKey,
@@ -77,7 +106,7 @@ func (s *TMProxyService) GetCurrentProxy(apiKey string) (*ProxyInfo, error) {
 	}
 
 	// Make HTTP request
-	req, err := http.NewRequest("POST", tmproxyGetCurrentURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", tmproxyGetCurrentURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -106,32 +135,66 @@ func (s *TMProxyService) GetCurrentProxy(apiKey string) (*ProxyInfo, error) {
 	}
 
 	// Parse expired_at timestamp (format: "HH:MM:SS DD/MM/YYYY")
-	expiresAt, err := time.Parse("15:04:05 02/01/2006", tmResp.Data.ExpiredAt)
+	expiresAt, err := time.ParseInLocation("15:04:05 02/01/2006", tmResp.Data.ExpiredAt, tmproxyLocation)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse expired_at: %w", err)
 	}
 
-	// Format proxy string: "ip:port:username:password"
-	proxyStr := fmt.Sprintf("%s:%s:%s",
-		tmResp.Data.HTTPS,
-		tmResp.Data.Username,
-		tmResp.Data.Password,
-	)
+	upstream, socks5, err := tmproxyUpstreams(tmResp.Data.HTTPS, tmResp.Data.SOCKS5, tmResp.Data.Username, tmResp.Data.Password)
+	if err != nil {
+		return nil, err
+	}
 
 	return &ProxyInfo{
-		ProxyStr:       proxyStr,
+		Upstream:       upstream,
+		SOCKS5:         socks5,
 		ServiceType:    "tmproxy",
 		NextResetAfter: tmResp.Data.NextRequest,
 		ExpiresAt:      expiresAt,
 	}, nil
 }
 
-func (s *TMProxyService) GetNewProxy(apiKey string) (*ProxyInfo, error) {
+// tmproxyNewProxyRequest builds body of new proxy request. Location and
+// ISP options map to id_location and id_isp, other options are sent as
+// they are.
+func tmproxyNewProxyRequest(apiKey string, options Options) (map[string]any, error) {
+	location, ok, err := options.Int(OptionLocation)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		location = tmproxyDefaultLocation
+	}
+	isp, ok, err := options.Int(OptionISP)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		isp = tmproxyDefaultISP
+	}
+
+	body := make(map[string]any, len(options)+3)
+	for name, value := range options {
+		if name != OptionLocation && name != OptionISP {
+			body[name] = value
+		}
+	}
+	body["api_key"] = apiKey
+	body["id_location"] = location
+	body["id_isp"] = isp
+	return body, nil
+}
+
+func (s *TMProxyService) ValidateOptions(options Options) error {
+	_, err := tmproxyNewProxyRequest("", options)
+	return err
+}
+
+func (s *TMProxyService) GetNewProxy(ctx context.Context, apiKey string, options Options) (*ProxyInfo, error) {
 	// Prepare request
-	reqBody := tmproxyRequest{
-		APIKey:     apiKey,
-		IDLocation: 1, // Default location
-		IDISP:      1, // Default ISP
+	reqBody, err := tmproxyNewProxyRequest(apiKey, options)
+	if err != nil {
+		return nil, err
 	}
 
 	jsonData, err := json.Marshal(reqBody)
@@ -140,7 +203,7 @@ func (s *TMProxyService) GetNewProxy(apiKey string) (*ProxyInfo, error) {
 	}
 
 	// Make HTTP request
-	req, err := http.NewRequest("POST", tmproxyGetNewURL, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", tmproxyGetNewURL, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -164,24 +227,75 @@ func (s *TMProxyService) GetNewProxy(apiKey string) (*ProxyInfo, error) {
 		return nil, fmt.Errorf("tmproxy API error: code=%d, message=%s", tmResp.Code, tmResp.Message)
 	}
 
-	// Format proxy string: "ip:port:username:password"
-	// Use HTTPS proxy format (can also use SOCKS5)
-	proxyStr := fmt.Sprintf("%s:%s:%s",
-		tmResp.Data.HTTPS,
-		tmResp.Data.Username,
-		tmResp.Data.Password,
-	)
+	upstream, socks5, err := tmproxyUpstreams(tmResp.Data.HTTPS, tmResp.Data.SOCKS5, tmResp.Data.Username, tmResp.Data.Password)
+	if err != nil {
+		return nil, err
+	}
 
 	// Parse expired_at timestamp (format: "HH:MM:SS DD/MM/YYYY")
-	expiresAt, err := time.Parse("15:04:05 02/01/2006", tmResp.Data.ExpiredAt)
+	expiresAt, err := time.ParseInLocation("15:04:05 02/01/2006", tmResp.Data.ExpiredAt, tmproxyLocation)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse expired_at: %w", err)
 	}
 
 	return &ProxyInfo{
-		ProxyStr:       proxyStr,
+		Upstream:       upstream,
+		SOCKS5:         socks5,
 		ServiceType:    "tmproxy",
 		NextResetAfter: tmResp.Data.NextRequest,
 		ExpiresAt:      expiresAt,
 	}, nil
 }
+
+type tmproxyLocationResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		Locations []struct {
+			IDLocation int    `json:"id_location"`
+			Name       string `json:"name"`
+		} `json:"locations"`
+		ISPs []struct {
+			IDISP int    `json:"id_isp"`
+			Name  string `json:"name"`
+		} `json:"isps"`
+	} `json:"data"`
+}
+
+// ListOptions returns locations and ISPs TMProxy offers
+func (s *TMProxyService) ListOptions(ctx context.Context) (*ProviderOptions, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tmproxyLocationURL, bytes.NewBufferString("{}"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Parse response
+	var tmResp tmproxyLocationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tmResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+
+	if tmResp.Code != 0 {
+		return nil, fmt.Errorf("tmproxy API error: code=%d, message=%s", tmResp.Code, tmResp.Message)
+	}
+
+	options := &ProviderOptions{
+		Locations: make([]ProviderOption, 0, len(tmResp.Data.Locations)),
+		ISPs:      make([]ProviderOption, 0, len(tmResp.Data.ISPs)),
+	}
+	for _, location := range tmResp.Data.Locations {
+		options.Locations = append(options.Locations, ProviderOption{ID: location.IDLocation, Name: location.Name})
+	}
+	for _, isp := range tmResp.Data.ISPs {
+		options.ISPs = append(options.ISPs, ProviderOption{ID: isp.IDISP, Name: isp.Name})
+	}
+	return options, nil
+}
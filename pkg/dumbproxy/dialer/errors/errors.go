@@ -13,3 +13,11 @@ func (e ErrAccessDenied) Error() string {
 func (e ErrAccessDenied) Unwrap() error {
 	return e.Err
 }
+
+type ErrBadProxyStatus struct {
+	StatusCode int
+}
+
+func (e ErrBadProxyStatus) Error() string {
+	return fmt.Sprintf("bad status code from proxy: %d", e.StatusCode)
+}
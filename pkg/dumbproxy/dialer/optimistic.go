@@ -13,6 +13,7 @@ import (
 
 	xproxy "golang.org/x/net/proxy"
 
+	derrors "go-forward-proxy/pkg/dumbproxy/dialer/errors"
 	"go-forward-proxy/pkg/dumbproxy/tlsutil"
 )
 
@@ -145,7 +146,7 @@ func (c *futureH1ProxiedConn) Read(b []byte) (n int, err error) {
 			return 0, c.rErr
 		}
 		if resp.StatusCode != http.StatusOK {
-			c.rErr = fmt.Errorf("bad status code from proxy: %d", resp.StatusCode)
+			c.rErr = derrors.ErrBadProxyStatus{StatusCode: resp.StatusCode}
 			return 0, c.rErr
 		}
 		c.rDone = true
@@ -17,6 +17,7 @@ import (
 
 	xproxy "golang.org/x/net/proxy"
 
+	derrors "go-forward-proxy/pkg/dumbproxy/dialer/errors"
 	"go-forward-proxy/pkg/dumbproxy/tlsutil"
 )
 
@@ -135,7 +136,7 @@ func (d *HTTPProxyDialer) DialContext(ctx context.Context, network, address stri
 
 	if resp.StatusCode != http.StatusOK {
 		conn.Close()
-		return nil, fmt.Errorf("bad status code from proxy: %d", resp.StatusCode)
+		return nil, derrors.ErrBadProxyStatus{StatusCode: resp.StatusCode}
 	}
 
 	stopGuard()